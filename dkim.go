@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultDKIMHeaders are the header fields signed when an account does not
+// configure dkimHeaders.
+var defaultDKIMHeaders = []string{"From", "Sender", "Reply-To", "To", "Cc",
+	"Subject", "Date", "Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+// hasDKIM reports whether messages sent through the account are signed.
+func hasDKIM(s server) bool {
+	return s.DKIMDomain != "" || s.DKIMSelector != "" || s.DKIMKeyFile != ""
+}
+
+// validateDKIM checks the DKIM settings of the server.
+func validateDKIM(s server) error {
+	switch {
+	case s.DKIMDomain == "":
+		return errors.New("dkimDomain is missing")
+	case s.DKIMSelector == "":
+		return errors.New("dkimSelector is missing")
+	case s.DKIMKeyFile == "":
+		return errors.New("dkimKeyFile is missing")
+	}
+
+	if len(s.DKIMHeaders) > 0 {
+		for _, h := range s.DKIMHeaders {
+			if strings.EqualFold(h, "From") {
+				return nil
+			}
+		}
+		return errors.New("dkimHeaders must have From")
+	}
+	return nil
+}
+
+// readDKIMKey reads the private key from a PEM file, which holds either an
+// RSA key or, in PKCS #8 form, an RSA or Ed25519 key.
+func readDKIMKey(file string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in %s", file)
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("Key in %s is neither RSA nor Ed25519", file)
+	}
+}
+
+// relaxedHeader canonicalizes a header field with the relaxed algorithm of
+// RFC 6376: the name is lowercased, the value unfolded and runs of white space
+// are reduced to a single space, with none around the colon and at the end.
+func relaxedHeader(f headerField) string {
+	raw := string(f.raw)
+	value := raw[strings.IndexByte(raw, ':')+1:]
+	value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+	value = strings.Join(strings.FieldsFunc(value, func(c rune) bool {
+		return c == ' ' || c == '\t'
+	}), " ")
+	return strings.ToLower(strings.TrimRight(f.name, " \t")) + ":" + value + "\r\n"
+}
+
+// relaxedBodyHash returns the SHA-256 hash of the body canonicalized with the
+// relaxed algorithm of RFC 6376: white space is reduced as in header fields
+// but kept at the start of a line, and empty lines at the end are left out.
+func relaxedBodyHash(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	hash := sha256.New()
+
+	// Empty lines are only written once a line with content follows.
+	empty := 0
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		var buf bytes.Buffer
+		space := false
+		for _, c := range line {
+			if c == ' ' || c == '\t' {
+				space = true
+				continue
+			}
+			if space {
+				buf.WriteByte(' ')
+				space = false
+			}
+			buf.WriteByte(c)
+		}
+
+		if buf.Len() == 0 {
+			empty++
+		} else {
+			for ; empty > 0; empty-- {
+				hash.Write([]byte("\r\n"))
+			}
+			buf.WriteString("\r\n")
+			hash.Write(buf.Bytes())
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// dkimSignature returns the DKIM-Signature header field for the message,
+// signed with the key of the account using relaxed/relaxed canonicalization.
+// The field uses the line endings of the message.
+func dkimSignature(s server, msg io.Reader) (string, error) {
+	key, err := readDKIMKey(s.DKIMKeyFile)
+	if err != nil {
+		return "", configError(err)
+	}
+	algo := "rsa-sha256"
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		algo = "ed25519-sha256"
+	}
+
+	br := bufio.NewReader(msg)
+	fields, sep, err := readHeader(br)
+	if err != nil {
+		return "", err
+	}
+	// A message may end in the header, without sep to tell the line ending.
+	eol := (&message{fields: fields, sep: sep}).eol()
+
+	// Anything in sep after the empty line belongs to the body.
+	var body io.Reader = br
+	if i := bytes.IndexByte(sep, '\n'); i >= 0 {
+		body = io.MultiReader(bytes.NewReader(sep[i+1:]), br)
+	}
+	bodyHash, err := relaxedBodyHash(body)
+	if err != nil {
+		return "", err
+	}
+
+	// A field that occurs more than once is signed as often, from the
+	// bottom up as RFC 6376 requires.
+	names := s.DKIMHeaders
+	if len(names) == 0 {
+		names = defaultDKIMHeaders
+	}
+	var signed []headerField
+	var h []string
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fields[i].name, name) {
+				signed = append(signed, fields[i])
+				h = append(h, strings.ToLower(name))
+			}
+		}
+	}
+
+	sig := "DKIM-Signature: v=1; a=" + algo + "; c=relaxed/relaxed;" + eol +
+		"\td=" + s.DKIMDomain + "; s=" + s.DKIMSelector + ";" + eol +
+		"\tt=" + strconv.FormatInt(time.Now().Unix(), 10) + ";" + eol +
+		"\th=" + strings.Join(h, ":") + ";" + eol +
+		"\tbh=" + base64.StdEncoding.EncodeToString(bodyHash) + ";" + eol +
+		"\tb="
+
+	// The signature covers the signed fields and the DKIM-Signature field
+	// itself with an empty b= tag and without the final line ending.
+	hash := sha256.New()
+	for _, f := range signed {
+		hash.Write([]byte(relaxedHeader(f)))
+	}
+	hash.Write([]byte(strings.TrimSuffix(
+		relaxedHeader(headerField{"DKIM-Signature", []byte(sig)}), "\r\n")))
+
+	var b []byte
+	if algo == "ed25519-sha256" {
+		// RFC 8463 signs the hash with PureEdDSA.
+		b, err = key.Sign(rand.Reader, hash.Sum(nil), crypto.Hash(0))
+	} else {
+		b, err = key.Sign(rand.Reader, hash.Sum(nil), crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// The signature is folded into lines short enough for any server.
+	enc := base64.StdEncoding.EncodeToString(b)
+	for len(enc) > 64 {
+		sig += enc[:64] + eol + "\t"
+		enc = enc[64:]
+	}
+	return sig + enc + eol, nil
+}
+
+// signEntry adds a DKIM-Signature header field for the account to the message
+// of the queue entry id.
+func signEntry(dir, id string, s server) error {
+	file := queueFile(dir, id, msgSuffix)
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sig, err := dkimSignature(s, f)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, id+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.WriteString(tmp, sig); err == nil {
+		_, err = io.Copy(tmp, f)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// The example key and message of RFC 8463, appendix A.
+const (
+	rfc8463Seed     = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+	rfc8463Public   = "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+	rfc8463BodyHash = "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8="
+
+	rfc8463Message = "From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n" +
+		"\r\n" +
+		"We lost the game.  Are you hungry yet?\r\n" +
+		"\r\n" +
+		"Joe.\r\n"
+
+	rfc8463Signature = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n"
+)
+
+var (
+	wsp       = regexp.MustCompile(`[ \t]+`)
+	bTag      = regexp.MustCompile(`(;[ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+	dkimField = regexp.MustCompile(`(?i)^dkim-signature[ \t]*:`)
+)
+
+// canonHeader canonicalizes a header field, given with its line breaks, with
+// the relaxed algorithm of RFC 6376, section 3.4.2.
+func canonHeader(field string) string {
+	i := strings.Index(field, ":")
+	name := strings.ToLower(strings.TrimRight(field[:i], " \t"))
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	value = strings.Trim(wsp.ReplaceAllString(value, " "), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// canonBody canonicalizes a body with the relaxed algorithm of RFC 6376,
+// section 3.4.4.
+func canonBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(wsp.ReplaceAllString(line, " "), " ")
+	}
+	body = strings.TrimRight(strings.Join(lines, "\r\n"), "\r\n")
+	if body == "" {
+		return ""
+	}
+	return body + "\r\n"
+}
+
+// verifyDKIM checks the first DKIM-Signature field of the message with the
+// public key the way a receiver does, which sees the message with CRLF line
+// endings, and returns the tags of the field.
+func verifyDKIM(msg string, pub crypto.PublicKey) (map[string]string, error) {
+	msg = strings.Replace(strings.Replace(msg, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	header, body := msg, ""
+	if i := strings.Index(msg, "\r\n\r\n"); i >= 0 {
+		header, body = msg[:i+2], msg[i+4:]
+	} else if !strings.HasSuffix(header, "\r\n") {
+		header += "\r\n"
+	}
+
+	var fields []string
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		switch {
+		case line == "":
+		case line[0] == ' ' || line[0] == '\t':
+			fields[len(fields)-1] += line
+		default:
+			fields = append(fields, line)
+		}
+	}
+
+	sig := -1
+	for i, f := range fields {
+		if dkimField.MatchString(f) {
+			sig = i
+			break
+		}
+	}
+	if sig < 0 {
+		return nil, errors.New("no DKIM-Signature")
+	}
+
+	tags := make(map[string]string)
+	value := fields[sig][strings.Index(fields[sig], ":")+1:]
+	for _, tag := range strings.Split(value, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		tags[strings.TrimSpace(kv[0])] = strings.Join(strings.Fields(kv[1]), "")
+	}
+
+	bh := sha256.Sum256([]byte(canonBody(body)))
+	if got := base64.StdEncoding.EncodeToString(bh[:]); got != tags["bh"] {
+		return tags, fmt.Errorf("bh=%s, want %s", tags["bh"], got)
+	}
+
+	// The fields named in h= are signed from the bottom up, each instance
+	// once, and names without an instance left sign nothing.
+	hash := sha256.New()
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			colon := strings.Index(fields[i], ":")
+			if used[i] || i == sig || colon < 0 || !strings.EqualFold(
+				strings.TrimRight(fields[i][:colon], " \t"), name) {
+				continue
+			}
+			used[i] = true
+			hash.Write([]byte(canonHeader(fields[i])))
+			break
+		}
+	}
+	unsigned := bTag.ReplaceAllString(fields[sig], "$1")
+	hash.Write([]byte(strings.TrimSuffix(canonHeader(unsigned), "\r\n")))
+	sum := hash.Sum(nil)
+
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return tags, err
+	}
+	switch tags["a"] {
+	case "rsa-sha256":
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return tags, errors.New("a=rsa-sha256 with a key that is not RSA")
+		}
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum, b)
+	case "ed25519-sha256":
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return tags, errors.New("a=ed25519-sha256 with a key that is not Ed25519")
+		}
+		if !ed25519.Verify(key, sum, b) {
+			err = errors.New("ed25519: verification error")
+		}
+	default:
+		err = fmt.Errorf("unknown a=%s", tags["a"])
+	}
+	return tags, err
+}
+
+func rfc8463Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	seed, err := base64.StdEncoding.DecodeString(rfc8463Seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	pub := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	if pub != rfc8463Public {
+		t.Fatalf("public key %s, want %s", pub, rfc8463Public)
+	}
+	return key
+}
+
+// TestVerifyDKIM checks the verifier of the tests against the signed example
+// of RFC 8463.
+func TestVerifyDKIM(t *testing.T) {
+	pub := rfc8463Key(t).Public()
+
+	if _, err := verifyDKIM(rfc8463Signature+rfc8463Message, pub); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := strings.Replace(rfc8463Message, "dinner", "lunch", 1)
+	if _, err := verifyDKIM(rfc8463Signature+tampered, pub); err == nil {
+		t.Error("changed Subject verified")
+	}
+	tampered = strings.Replace(rfc8463Message, "Joe.", "Jim.", 1)
+	if _, err := verifyDKIM(rfc8463Signature+tampered, pub); err == nil {
+		t.Error("changed body verified")
+	}
+}
+
+// writeKey writes the private key to a PEM file in dir and returns its name.
+func writeKey(t *testing.T, dir, name, typ string, der []byte) string {
+	t.Helper()
+	file := path.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestDKIMSignature(t *testing.T) {
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPKCS8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := rfc8463Key(t)
+	edPKCS8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []struct {
+		name string
+		file string
+		pub  crypto.PublicKey
+		algo string
+	}{
+		{"rsa pkcs1", writeKey(t, dir, "rsa1.pem", "RSA PRIVATE KEY",
+			x509.MarshalPKCS1PrivateKey(rsaKey)), rsaKey.Public(), "rsa-sha256"},
+		{"rsa pkcs8", writeKey(t, dir, "rsa8.pem", "PRIVATE KEY", rsaPKCS8),
+			rsaKey.Public(), "rsa-sha256"},
+		{"ed25519", writeKey(t, dir, "ed.pem", "PRIVATE KEY", edPKCS8),
+			edKey.Public(), "ed25519-sha256"},
+	}
+
+	emptyHash := sha256.Sum256(nil)
+	lf := strings.Replace(rfc8463Message, "\r\n", "\n", -1)
+	messages := []struct {
+		name string
+		msg  string
+		h    string // the signed fields, unless empty
+		bh   string // the body hash, unless empty
+	}{
+		{"rfc 8463", rfc8463Message, "from:to:subject:date:message-id",
+			rfc8463BodyHash},
+		{"lf", lf, "", rfc8463BodyHash},
+		{"trailing blank lines", rfc8463Message + "\r\n \r\n\t\r\n\r\n", "",
+			rfc8463BodyHash},
+		{"trailing blank lines lf", lf + "\n\n  \n", "", rfc8463BodyHash},
+		{"white space", strings.Replace(rfc8463Message, "Joe.", " Joe. \t ", 1),
+			"", ""},
+		{"folded", "From: Joe SixPack\n <joe@football.example.com>\n" +
+			"To: suzie@shopping.example.net,\n\t  tom@shopping.example.net\n" +
+			"Subject:   Is dinner\n   ready?  \n\nHi.\n", "from:to:subject", ""},
+		{"folded crlf", "From: joe@football.example.com\r\n" +
+			"Subject: Is dinner\r\n \tready?\r\n\r\nHi.\r\n", "from:subject", ""},
+		{"repeated", "From: joe@football.example.com\n" +
+			"To: suzie@shopping.example.net\nSubject: one\n" +
+			"To: tom@shopping.example.net\nsubject : two\n\nHi.\n",
+			"from:to:to:subject:subject", ""},
+		{"empty body", "From: joe@football.example.com\n\n", "from",
+			base64.StdEncoding.EncodeToString(emptyHash[:])},
+		{"empty body crlf", "From: joe@football.example.com\r\n\r\n\r\n", "from",
+			base64.StdEncoding.EncodeToString(emptyHash[:])},
+		{"no body", "From: joe@football.example.com\r\nSubject: x\r\n",
+			"from:subject", base64.StdEncoding.EncodeToString(emptyHash[:])},
+		{"no line break", "From: joe@football.example.com\n\nHi.", "from", ""},
+	}
+
+	for _, k := range keys {
+		for _, m := range messages {
+			qdir := t.TempDir()
+			id := "0000000000000001"
+			file := queueFile(qdir, id, msgSuffix)
+			if err := ioutil.WriteFile(file, []byte(m.msg), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			s := server{
+				DKIMDomain:   "football.example.com",
+				DKIMSelector: "brisbane",
+				DKIMKeyFile:  k.file,
+			}
+			if err := signEntry(qdir, id, s); err != nil {
+				t.Errorf("%s, %s: %v", k.name, m.name, err)
+				continue
+			}
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signed := string(data)
+
+			// The field is added in front of the message, which is left
+			// as it was, and uses the same line endings.
+			if !strings.HasSuffix(signed, m.msg) {
+				t.Errorf("%s, %s: message changed: %q", k.name, m.name, signed)
+				continue
+			}
+			field := strings.TrimSuffix(signed, m.msg)
+			want := strings.Replace(field, "\r\n", "\n", -1)
+			if strings.Contains(m.msg, "\r\n") {
+				want = strings.Replace(want, "\n", "\r\n", -1)
+			}
+			if field != want {
+				t.Errorf("%s, %s: line endings of %q", k.name, m.name, field)
+			}
+
+			tags, err := verifyDKIM(signed, k.pub)
+			if err != nil {
+				t.Errorf("%s, %s: %v\n%s", k.name, m.name, err, signed)
+				continue
+			}
+			wantTags := map[string]string{
+				"v":  "1",
+				"a":  k.algo,
+				"c":  "relaxed/relaxed",
+				"d":  "football.example.com",
+				"s":  "brisbane",
+				"h":  m.h,
+				"bh": m.bh,
+			}
+			for tag, v := range wantTags {
+				if v != "" && tags[tag] != v {
+					t.Errorf("%s, %s: %s=%s, want %s", k.name, m.name, tag,
+						tags[tag], v)
+				}
+			}
+
+			// Changing the message breaks the signature.
+			tampered := strings.Replace(signed, "joe@", "jim@", -1)
+			if _, err := verifyDKIM(tampered, k.pub); err == nil {
+				t.Errorf("%s, %s: changed From verified", k.name, m.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+)
+
+// Exit codes from sysexits.h, which callers of sendmail like MUAs and cron use
+// to tell whether sending should be retried or given up on.
+const (
+	exOK          = 0
+	exUsage       = 64
+	exDataErr     = 65
+	exNoUser      = 67
+	exNoHost      = 68
+	exUnavailable = 69
+	exSoftware    = 70
+	exCantCreat   = 73
+	exTempFail    = 75
+	exProtocol    = 76
+	exNoPerm      = 77
+	exConfig      = 78
+)
+
+// exitError is an error together with the exit code it is reported with.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+// configError is an error in the config file or the flags.
+func configError(err error) error {
+	return &exitError{exConfig, err}
+}
+
+// dataError is an error in the message that was passed in.
+func dataError(err error) error {
+	return &exitError{exDataErr, err}
+}
+
+// tempFailure is an error after which sending may be retried later.
+func tempFailure(err error) error {
+	return &exitError{exTempFail, err}
+}
+
+// permFailure is an error after which retrying will not help.
+func permFailure(err error) error {
+	return &exitError{exUnavailable, err}
+}
+
+// usageError is an error in the way gsmtp was invoked.
+func usageError(err error) error {
+	return &exitError{exUsage, err}
+}
+
+// exitCode returns the sysexits code for the error.  Errors that were not
+// classified where they happened are classified by their type: SMTP replies
+// by their code, network errors as temporary and certificate errors as
+// missing permission.
+func exitCode(err error) int {
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+
+	var re recipientError
+	if errors.As(err, &re) {
+		if re.temporary() {
+			return exTempFail
+		}
+		return exNoUser
+	}
+
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		switch {
+		case te.Code >= 530 && te.Code <= 535:
+			return exNoPerm
+		case te.Code >= 500:
+			return exUnavailable
+		case te.Code >= 400:
+			return exTempFail
+		default:
+			return exProtocol
+		}
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return exNoHost
+	}
+
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &certErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return exNoPerm
+	}
+
+	// Timeouts are reported as net.Error by the connection, but as the
+	// context error once the total timeout has passed.
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) ||
+		err == io.EOF || err == io.ErrUnexpectedEOF {
+		return exTempFail
+	}
+
+	var execErr *exec.ExitError
+	if errors.As(err, &execErr) {
+		// A passwordeval or tokeneval command may fail because, for
+		// example, the keyring is locked, which will not last.
+		return exTempFail
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return exConfig
+	}
+
+	return exSoftware
+}
+
+// fail logs the error, reports it in a single line on stderr and exits with
+// its sysexits code.
+func fail(err error) {
+	log.Printf("[ERROR] %v", err)
+	fmt.Fprintf(os.Stderr, "gsmtp: %v\n", err)
+	os.Exit(exitCode(err))
+}
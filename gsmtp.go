@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
@@ -16,11 +18,14 @@ import (
 	"net"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -47,183 +52,1077 @@ var configFileFlag = flag.String("config", defaultConfigFile,
 	"File to read configuration from")
 var logFileFlag = flag.String("logfile", defaultLogFile,
 	"File to write log to")
-var fromFlag = flag.String("f", "", "From address to select server")
+var queueDirFlag = flag.String("queuedir", defaultQueueDir,
+	"Directory to keep messages in until they are delivered")
+var queueFlag = flag.Bool("q", false, "Deliver the queued messages and quit")
+var listQueueFlag = flag.Bool("bp", false, "List the queued messages and quit")
+var deleteFlag = flag.String("delete", "", "Delete the queued message with ID")
+var holdFlag = flag.String("hold", "", "Put the queued message with ID on hold")
+var releaseFlag = flag.String("release", "",
+	"Release the queued message with ID from hold")
+var retryFlag = flag.String("retry", "",
+	"Deliver the queued message with ID now and quit")
+var fromFlag = flag.String("f", "",
+	"Envelope sender, which selects the server if there is no From header")
+var rFlag = flag.String("r", "", "Same as -f")
+var fullNameFlag = flag.String("F", "",
+	"Full name of the sender for a From header that is added")
 var accountFlag = flag.String("account", "", "Server to send email through")
 var debugFlag = flag.Bool("debug", false, "Verbose")
 var serverinfoFlag = flag.Bool("serverinfo", false, "Print server info and quit")
-var _ = flag.Bool("oi", false, "Ignored sendmail flag")
-var _ = flag.Bool("t", false, "Ignored sendmail flag")
+var pinFlag = flag.String("pin", "",
+	"Pin the certificate of the account's server in the config file and quit")
+var yesFlag = flag.Bool("yes", false, "Do not ask for confirmation with -pin")
+var extractFlag = flag.Bool("t", false,
+	"Read recipients from the To, Cc and Bcc headers, leaving out arguments")
+var ignoreDotsFlag = flag.Bool("i", false,
+	"Do not treat a line with a single dot as the end of the message")
+var oiFlag = flag.Bool("oi", false, "Same as -i")
 
 func printFlags() {
 	println("")
 	println("Flags:")
 	println("     account:", *accountFlag)
+	println("          bp:", *listQueueFlag)
 	println("      config:", *configFileFlag)
 	println("       debug:", *debugFlag)
+	println("      delete:", *deleteFlag)
 	println("           f:", *fromFlag)
+	println("           F:", *fullNameFlag)
+	println("        hold:", *holdFlag)
+	println("           i:", *ignoreDotsFlag || *oiFlag)
 	println("     logfile:", *logFileFlag)
+	println("         pin:", *pinFlag)
+	println("           r:", *rFlag)
+	println("           q:", *queueFlag)
+	println("    queuedir:", *queueDirFlag)
+	println("     release:", *releaseFlag)
+	println("       retry:", *retryFlag)
 	println("  serverinfo:", *serverinfoFlag)
+	println("           t:", *extractFlag)
+	println("         yes:", *yesFlag)
 }
 
+// TLS modes for a server.  With tlsStartTLS (the default) a plain connection
+// is upgraded with the STARTTLS command, while with tlsImplicit TLS is spoken
+// from the first byte (SMTPS, usually on port 465).
+const (
+	tlsStartTLS = "starttls"
+	tlsImplicit = "implicit"
+)
+
+// Root certificate modes for a server.  With rootSystem the server certificate
+// is verified against the system trust store, with rootPinned only against the
+// certificates from rootPEM and rootFile, and with rootBoth against either.
+// rootNone skips chain verification altogether and relies on the configured
+// fingerprints.  When no mode is given rootPinned is used if a root
+// certificate is configured, rootNone if only fingerprints are configured and
+// rootSystem otherwise.
+const (
+	rootSystem = "system"
+	rootPinned = "pinned"
+	rootBoth   = "both"
+	rootNone   = "none"
+)
+
+// Sender header policies for a server, which apply when the envelope sender
+// differs from the address in the From header.  With senderKeep (the default)
+// the header is left alone, with senderAdd a Sender field with the envelope
+// sender is added unless the message has one and with senderReplace it takes
+// the place of any Sender fields of the message.
+const (
+	senderKeep    = "keep"
+	senderAdd     = "add"
+	senderReplace = "replace"
+)
+
+// Fingerprint match modes for a server.  With matchLeaf one of the configured
+// fingerprints has to be the one of the server certificate itself, with
+// matchChain it may be the one of any certificate the server presents.
+const (
+	matchLeaf  = "leaf"
+	matchChain = "chain"
+)
+
+// Authentication mechanisms for a server.  With authAuto (the default) the
+// strongest mechanism advertised by the server that gsmtp supports is used,
+// in the order given by authPreference, or by oauthPreference for servers
+// with tokeneval or tokenURL.  With authNone no authentication is attempted.
+const (
+	authAuto        = "auto"
+	authPlain       = "plain"
+	authLogin       = "login"
+	authCRAMMD5     = "cram-md5"
+	authSCRAMSHA1   = "scram-sha-1"
+	authSCRAMSHA256 = "scram-sha-256"
+	authXOAuth2     = "xoauth2"
+	authOAuthBearer = "oauthbearer"
+	authNone        = "none"
+)
+
+var authPreference = []string{authSCRAMSHA256, authSCRAMSHA1, authCRAMMD5,
+	authPlain, authLogin}
+var oauthPreference = []string{authOAuthBearer, authXOAuth2}
+
 type server struct {
-	Addr     string   `toml:"address,omitempty"`
-	From     string   `toml:"from"`
-	Username string   `toml:"username"`
-	PassEval []string `toml:"passwordeval"`
-	RootPEM  string   `toml:"rootPEM,omitempty"`
+	Addr      string   `toml:"address,omitempty"`
+	Addresses []string `toml:"addresses,omitempty"`
+	Fallback  string   `toml:"fallback,omitempty"`
+	Proxy     string   `toml:"proxy,omitempty"`
+	Helo      string   `toml:"helo,omitempty"`
+	LocalAddr string   `toml:"localAddr,omitempty"`
+	From      string   `toml:"from,omitempty"`
+	Username  string   `toml:"username,omitempty"`
+	PassEval  []string `toml:"passwordeval,omitempty"`
+	RootPEM   string   `toml:"rootPEM,omitempty"`
+	RootFile  string   `toml:"rootFile,omitempty"`
+	RootMode  string   `toml:"rootMode,omitempty"`
+	TLS       string   `toml:"tls,omitempty"`
+	Auth      string   `toml:"auth,omitempty"`
+
+	Aliases         []string `toml:"aliases,omitempty"`
+	Match           []string `toml:"match,omitempty"`
+	MatchRecipients []string `toml:"matchRecipients,omitempty"`
+
+	EnvelopeFrom    string `toml:"envelopeFrom,omitempty"`
+	SenderHeader    string `toml:"senderHeader,omitempty"`
+	MessageIDDomain string `toml:"messageIdDomain,omitempty"`
+
+	DKIMDomain   string   `toml:"dkimDomain,omitempty"`
+	DKIMSelector string   `toml:"dkimSelector,omitempty"`
+	DKIMKeyFile  string   `toml:"dkimKeyFile,omitempty"`
+	DKIMHeaders  []string `toml:"dkimHeaders,omitempty"`
+
+	RequireAllRecipients bool `toml:"requireAllRecipients,omitempty"`
+	MaxRecipients        int  `toml:"maxRecipients,omitzero"`
+
+	TokenEval        []string `toml:"tokeneval,omitempty"`
+	TokenURL         string   `toml:"tokenURL,omitempty"`
+	ClientID         string   `toml:"clientID,omitempty"`
+	ClientSecret     string   `toml:"clientSecret,omitempty"`
+	RefreshTokenEval []string `toml:"refreshtokeneval,omitempty"`
+
+	Fingerprints     []string `toml:"fingerprints,omitempty"`
+	FingerprintMatch string   `toml:"fingerprintMatch,omitempty"`
+
+	ConnectTimeout duration `toml:"connectTimeout,omitzero"`
+	CommandTimeout duration `toml:"commandTimeout,omitzero"`
+	TotalTimeout   duration `toml:"totalTimeout,omitzero"`
 }
 type gsmtpConfig struct {
-	DefaultServer string `toml:"default"`
-	Servers       map[string]server
+	DefaultServer     string            `toml:"default"`
+	QueueMaxAge       duration          `toml:"queueMaxAge,omitzero"`
+	RejectUnknownFrom bool              `toml:"rejectUnknownFrom,omitempty"`
+	Servers           map[string]server `toml:"servers"`
+}
+
+// duration is a time.Duration that is written like "1h30m" in the config file.
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// hasOAuth reports whether an OAuth2 token source is configured for the server.
+func hasOAuth(s server) bool {
+	return len(s.TokenEval) > 0 || s.TokenURL != ""
+}
+
+// hasCredentials reports whether any credentials are configured for the
+// server.  Servers without credentials, like relays that accept mail by IP
+// address, are used without authentication unless auth says otherwise.
+func hasCredentials(s server) bool {
+	return s.Username != "" || len(s.PassEval) > 0 || hasOAuth(s)
+}
+
+// validateServer checks the settings of a server so that mistakes are
+// reported when the config is read rather than halfway through a delivery.
+func validateServer(s server) error {
+	if s.Addr == "" {
+		return errors.New("address is missing")
+	}
+	for _, addr := range append([]string{s.Addr}, s.Addresses...) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return err
+		}
+	}
+
+	if s.Proxy != "" {
+		if _, err := parseProxy(s.Proxy); err != nil {
+			return err
+		}
+	}
+	for _, pattern := range append(s.Match, s.MatchRecipients...) {
+		if err := validatePattern(pattern); err != nil {
+			return fmt.Errorf("Bad pattern %q: %v", pattern, err)
+		}
+	}
+
+	switch s.SenderHeader {
+	case "", senderKeep, senderAdd, senderReplace:
+	default:
+		return fmt.Errorf("Unknown senderHeader %q", s.SenderHeader)
+	}
+
+	if hasDKIM(s) {
+		if err := validateDKIM(s); err != nil {
+			return err
+		}
+	}
+
+	if strings.ContainsAny(s.Helo, " \t\r\n") {
+		return fmt.Errorf("helo %q contains white space", s.Helo)
+	}
+	if s.LocalAddr != "" && net.ParseIP(s.LocalAddr) == nil {
+		return fmt.Errorf("localAddr %q is not an IP address", s.LocalAddr)
+	}
+
+	switch s.TLS {
+	case "", tlsStartTLS, tlsImplicit:
+	default:
+		return fmt.Errorf("Unknown tls mode %q", s.TLS)
+	}
+
+	switch rootMode(s) {
+	case rootSystem:
+	case rootPinned, rootBoth:
+		if s.RootPEM == "" && s.RootFile == "" {
+			return fmt.Errorf("rootMode %q needs rootPEM or rootFile",
+				rootMode(s))
+		}
+	case rootNone:
+		if len(s.Fingerprints) == 0 {
+			return errors.New("rootMode \"none\" needs fingerprints")
+		}
+	default:
+		return fmt.Errorf("Unknown rootMode %q", s.RootMode)
+	}
+
+	switch s.FingerprintMatch {
+	case "", matchLeaf, matchChain:
+	default:
+		return fmt.Errorf("Unknown fingerprintMatch %q", s.FingerprintMatch)
+	}
+
+	if s.MaxRecipients < 0 {
+		return fmt.Errorf("maxRecipients %d is negative", s.MaxRecipients)
+	}
+
+	password := func() error {
+		if s.Username == "" {
+			return errors.New("username is missing")
+		}
+		if len(s.PassEval) == 0 {
+			return errors.New("passwordeval is missing")
+		}
+		return nil
+	}
+	oauth := func() error {
+		if !hasOAuth(s) {
+			return errors.New("tokeneval or tokenURL is missing")
+		}
+		if len(s.TokenEval) == 0 && len(s.RefreshTokenEval) == 0 {
+			return errors.New("refreshtokeneval is missing")
+		}
+		return nil
+	}
+
+	switch strings.ToLower(s.Auth) {
+	case "", authAuto:
+		if hasOAuth(s) {
+			return oauth()
+		}
+		if hasCredentials(s) {
+			return password()
+		}
+	case authNone:
+	case authPlain, authLogin, authCRAMMD5, authSCRAMSHA1, authSCRAMSHA256:
+		return password()
+	case authXOAuth2, authOAuthBearer:
+		return oauth()
+	default:
+		return fmt.Errorf("Unknown auth %q", s.Auth)
+	}
+
+	return nil
+}
+
+func validateConfig(config gsmtpConfig) error {
+	if config.DefaultServer != "" {
+		if _, ok := config.Servers[config.DefaultServer]; !ok {
+			return fmt.Errorf("Default account %q is not configured",
+				config.DefaultServer)
+		}
+	}
+
+	for name, s := range config.Servers {
+		if err := validateServer(s); err != nil {
+			return fmt.Errorf("Account %q: %v", name, err)
+		}
+		if _, ok := config.Servers[s.Fallback]; s.Fallback != "" && !ok {
+			return fmt.Errorf("Account %q: Fallback account %q is not configured",
+				name, s.Fallback)
+		}
+	}
+
+	return nil
 }
 
 func printConfig(config gsmtpConfig) {
 	println("")
 	println("Config:")
 	println("  Default server:", config.DefaultServer)
+	println("  Queue max age:", time.Duration(config.QueueMaxAge).String())
+	println("  Reject unknown from:", config.RejectUnknownFrom)
 	for name, s := range config.Servers {
 		println("  ~~~~~~~~~")
 		println("    Server:", name)
 		println("      Addr:", s.Addr)
+		println("  Addresses:", strings.Join(s.Addresses, ", "))
+		println("  Fallback:", s.Fallback)
+		if proxy, err := parseProxy(s.Proxy); err == nil {
+			println("     Proxy:", proxy.Redacted())
+		}
+		println("      Helo:", s.Helo)
+		println("  LocalAddr:", s.LocalAddr)
 		println("      From:", s.From)
+		println("   Aliases:", strings.Join(s.Aliases, ", "))
+		println("     Match:", strings.Join(s.Match, ", "))
+		println("  MatchRecipients:", strings.Join(s.MatchRecipients, ", "))
+		println("  EnvelopeFrom:", s.EnvelopeFrom)
+		println("  SenderHeader:", s.SenderHeader)
+		println("  MessageIDDomain:", s.MessageIDDomain)
+		println("  DKIMDomain:", s.DKIMDomain)
+		println("  DKIMSelector:", s.DKIMSelector)
+		println("  DKIMKeyFile:", s.DKIMKeyFile)
+		println("  DKIMHeaders:", strings.Join(s.DKIMHeaders, ", "))
 		println("  Username:", s.Username)
 		println("  PassEval:", s.PassEval)
+		println("       TLS:", s.TLS)
+		println("      Auth:", s.Auth)
+		println("  RequireAllRecipients:", s.RequireAllRecipients)
+		println("  MaxRecipients:", s.MaxRecipients)
+		println("  TokenEval:", s.TokenEval)
+		println("  TokenURL:", s.TokenURL)
+		println("  ClientID:", s.ClientID)
+		println("  RefreshTokenEval:", s.RefreshTokenEval)
+		println("  RootFile:", s.RootFile)
+		println("  RootMode:", s.RootMode)
+		println("  Fingerprints:", strings.Join(s.Fingerprints, ", "))
+		println("  FingerprintMatch:", s.FingerprintMatch)
+		println("  ConnectTimeout:", time.Duration(s.ConnectTimeout).String())
+		println("  CommandTimeout:", time.Duration(s.CommandTimeout).String())
+		println("  TotalTimeout:", time.Duration(s.TotalTimeout).String())
 		println("   RootPEM:\n", s.RootPEM)
 	}
 }
 
+// getPeerCertificates connects to the server without verifying its
+// certificate and returns the certificate chain it presents.
+func getPeerCertificates(s server) ([]*x509.Certificate, error) {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         host,
+	}
+
+	ctx, cancel := serverContext(s)
+	defer cancel()
+
+	c, err := dial(ctx, s, config)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	state, ok := c.TLSConnectionState()
+	if !ok {
+		return nil, errors.New("Problem getting TLS state")
+	}
+
+	if err = c.Quit(); err != nil {
+		return nil, err
+	}
+
+	return state.PeerCertificates, nil
+}
+
+func printCertificates(certs []*x509.Certificate) {
+	for _, cert := range certs {
+		for i, dnsname := range cert.DNSNames {
+			fmt.Printf("DNSnames[%d]: %s\n", i, dnsname)
+		}
+		for i, value := range cert.CRLDistributionPoints {
+			fmt.Printf("CRLDistributionPoints[%d]: %s\n", i, value)
+		}
+		for i, value := range cert.IssuingCertificateURL {
+			fmt.Printf("IssuingCertificateURL[%d]: %s\n", i, value)
+		}
+		fmt.Printf("SHA-256 Fingerprint:\n %s\n", fingerprint(cert))
+
+		pemBlock := pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: cert.Raw,
+		}
+		fmt.Print(string(pem.EncodeToMemory(&pemBlock)))
+
+		fmt.Printf("\n")
+	}
+}
+
 func printServerInfo(config gsmtpConfig) error {
 	for name, s := range config.Servers {
 		fmt.Printf("\n------------------------------------------------------------------------\n")
 		fmt.Printf("  Server info for: %s\n", name)
 		fmt.Printf("------------------------------------------------------------------------\n")
 
-		host, _, err := net.SplitHostPort(s.Addr)
+		certs, err := getPeerCertificates(s)
 		if err != nil {
 			return err
 		}
 
-		config := &tls.Config{
-			InsecureSkipVerify: true,
-			ServerName:         host,
+		printCertificates(certs)
+
+		fmt.Printf("------------------------------------------------------------------------\n\n\n")
+	}
+
+	return nil
+}
+
+// pinServer connects to the server of the named account, shows the
+// certificate chain it presents and, once confirmed, writes the top of the
+// chain to the account's rootPEM and the fingerprint of the server
+// certificate to its fingerprints.  The other accounts are written back
+// unchanged.
+func pinServer(config gsmtpConfig, name string) error {
+	s, ok := config.Servers[name]
+	if !ok {
+		return fmt.Errorf("Unknown account %q", name)
+	}
+
+	certs, err := getPeerCertificates(s)
+	if err != nil {
+		return err
+	}
+	if len(certs) == 0 {
+		return errors.New("Server presented no certificate")
+	}
+
+	printCertificates(certs)
+
+	root := certs[len(certs)-1]
+	leaf := fingerprint(certs[0])
+
+	fmt.Printf("Pin %s to the root certificate for %s and fingerprint\n %s\n",
+		name, root.Subject, leaf)
+	if !*yesFlag {
+		fmt.Printf("Write to %s? [y/N] ", *configFileFlag)
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			return &exitError{exNoPerm, errors.New("Pinning aborted")}
 		}
+	}
+
+	pemBlock := pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: root.Raw,
+	}
+	s.RootPEM = string(pem.EncodeToMemory(&pemBlock))
+	s.Fingerprints = []string{leaf}
+	config.Servers[name] = s
 
-		c, err := smtp.Dial(s.Addr)
+	return writeTOML(*configFileFlag, config)
+}
+
+// writeTOML replaces the file with the TOML encoding of v.  The new file is
+// written next to the old one, readable only by the user, and renamed into
+// place so that a failure does not leave a truncated file behind.  A symlink is
+// followed, so that the file it points to is replaced rather than the link,
+// which may be managed with the rest of the dotfiles.
+func writeTOML(file string, v interface{}) error {
+	if target, err := filepath.EvalSymlinks(file); err == nil {
+		file = target
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = toml.NewEncoder(tmp).Encode(v); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// dial connects to the server and negotiates TLS according to its tls mode,
+// either by issuing STARTTLS after the greeting or by starting the TLS
+// handshake right away.  The connection is subject to the timeouts of the
+// server and ends with ctx.
+func dial(ctx context.Context, s server, config *tls.Config) (*smtp.Client, error) {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.TLS {
+	case "", tlsStartTLS:
+		conn, err := dialConn(ctx, s)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		c, err := smtp.NewClient(conn, host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err = c.Hello(heloName(ctx, s)); err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, permFailure(
+				errors.New("Server does not have the extension STARTTLS"))
+		}
+		if err = c.StartTLS(config); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+
+	case tlsImplicit:
+		raw, err := dialConn(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+
+		conn := tls.Client(raw, config)
+		if err = conn.HandshakeContext(ctx); err != nil {
+			raw.Close()
+			return nil, err
+		}
+
+		c, err := smtp.NewClient(conn, host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err = c.Hello(heloName(ctx, s)); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown tls mode %q", s.TLS)
+	}
+}
+
+// heloName returns the name to greet the server with, which is its helo
+// setting or else the fully qualified domain name of this host.
+func heloName(ctx context.Context, s server) string {
+	if s.Helo != "" {
+		return s.Helo
+	}
+	return localFQDN(ctx)
+}
+
+// localFQDN returns the fully qualified domain name of this host.  When the
+// hostname has no domain it is looked for among the names of the addresses of
+// the host, and without one the hostname is used as it is.
+func localFQDN(ctx context.Context) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	if strings.Contains(hostname, ".") {
+		return hostname
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, hostname)
+	if err != nil {
+		return hostname
+	}
+	for _, addr := range addrs {
+		names, err := net.DefaultResolver.LookupAddr(ctx, addr)
+		if err != nil {
+			continue
 		}
-		defer c.Close()
+		for _, name := range names {
+			name = strings.TrimSuffix(name, ".")
+			if strings.Contains(name, ".") &&
+				!strings.HasPrefix(name, "localhost") {
+				return name
+			}
+		}
+	}
+
+	return hostname
+}
 
-		if ok, _ := c.Extension("STARTTLS"); ok {
-			if err = c.StartTLS(config); err != nil {
-				return err
+// fingerprint returns the SHA-256 fingerprint of the certificate in the form
+// printed by -serverinfo.
+func fingerprint(cert *x509.Certificate) string {
+	hash := sha256.New()
+	hash.Write(cert.Raw)
+	return fmt.Sprintf("%X", hash.Sum(nil))
+}
+
+// normalizeFingerprint allows fingerprints to be configured in lower case and
+// with the usual colon or space separators.
+func normalizeFingerprint(f string) string {
+	f = strings.Replace(f, ":", "", -1)
+	f = strings.Replace(f, " ", "", -1)
+	return strings.ToUpper(f)
+}
+
+// checkFingerprints verifies that one of the certificates presented by the
+// server, as selected by fingerprintMatch, has one of the configured
+// fingerprints.
+func checkFingerprints(s server, state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("Server presented no certificate")
+	}
+
+	var certs []*x509.Certificate
+	switch s.FingerprintMatch {
+	case "", matchLeaf:
+		certs = state.PeerCertificates[:1]
+	case matchChain:
+		certs = state.PeerCertificates
+	default:
+		return fmt.Errorf("Unknown fingerprintMatch %q", s.FingerprintMatch)
+	}
+
+	for _, cert := range certs {
+		f := fingerprint(cert)
+		for _, pin := range s.Fingerprints {
+			if normalizeFingerprint(pin) == f {
+				return nil
 			}
-		} else {
-			return errors.New("Server does not have the extension STARTTLS")
 		}
+	}
+
+	return &exitError{exNoPerm, fmt.Errorf(
+		"Server certificate %s does not match any fingerprint",
+		fingerprint(state.PeerCertificates[0]))}
+}
 
-		state, ok := c.TLSConnectionState()
+// getTLSConfig builds the TLS configuration used to deliver mail through the
+// server.  The fingerprints are checked as part of the handshake so a server
+// that does not match never sees the credentials.
+func getTLSConfig(s server) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := getRootCAs(s)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		ServerName: host,
+		RootCAs:    roots,
+	}
+
+	if rootMode(s) == rootNone {
+		config.InsecureSkipVerify = true
+	}
+
+	if len(s.Fingerprints) > 0 {
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return checkFingerprints(s, state)
+		}
+	}
+
+	return config, nil
+}
+
+// rootMode returns the configured rootMode of the server or its default.
+func rootMode(s server) string {
+	if s.RootMode != "" {
+		return s.RootMode
+	}
+	if s.RootPEM != "" || s.RootFile != "" {
+		return rootPinned
+	}
+	if len(s.Fingerprints) > 0 {
+		return rootNone
+	}
+	return rootSystem
+}
+
+// getRootCAs builds the pool of root certificates the server is verified
+// against according to its rootMode.  A nil pool means the system trust store.
+func getRootCAs(s server) (*x509.CertPool, error) {
+	pinned := s.RootPEM != "" || s.RootFile != ""
+
+	mode := rootMode(s)
+
+	var roots *x509.CertPool
+	switch mode {
+	case rootSystem:
+		return nil, nil
+	case rootNone:
+		if len(s.Fingerprints) == 0 {
+			return nil, errors.New("rootMode \"none\" needs fingerprints")
+		}
+		return nil, nil
+	case rootPinned:
+		roots = x509.NewCertPool()
+	case rootBoth:
+		var err error
+		roots, err = x509.SystemCertPool()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown rootMode %q", s.RootMode)
+	}
+
+	if !pinned {
+		return nil, fmt.Errorf("rootMode %q needs rootPEM or rootFile", mode)
+	}
+
+	if s.RootPEM != "" {
+		if ok := roots.AppendCertsFromPEM([]byte(s.RootPEM)); !ok {
+			return nil, errors.New("Failed to parse root certificate")
+		}
+	}
+
+	if s.RootFile != "" {
+		rootPEM, err := ioutil.ReadFile(s.RootFile)
+		if err != nil {
+			return nil, err
+		}
+		if ok := roots.AppendCertsFromPEM(rootPEM); !ok {
+			return nil, fmt.Errorf("Failed to parse root certificate in %s",
+				s.RootFile)
+		}
+	}
+
+	return roots, nil
+}
+
+// hop is an address of an account a message can be sent through.
+type hop struct {
+	account string
+	s       server
+}
+
+// getHops returns the hops of the account in the order they are tried: its
+// address, its addresses and then the hops of its fallback account.
+func getHops(config gsmtpConfig, name string) []hop {
+	var hops []hop
+	seen := make(map[string]bool)
+	for name != "" && !seen[name] {
+		seen[name] = true
+		s, ok := config.Servers[name]
 		if !ok {
-			return errors.New("Problem getting TLS state")
+			break
+		}
+		for _, addr := range append([]string{s.Addr}, s.Addresses...) {
+			h := hop{name, s}
+			h.s.Addr = addr
+			hops = append(hops, h)
 		}
+		name = s.Fallback
+	}
+	return hops
+}
 
-		for _, cert := range state.PeerCertificates {
-			for i, dnsname := range cert.DNSNames {
-				fmt.Printf("DNSnames[%d]: %s\n", i, dnsname)
-			}
-			for i, value := range cert.CRLDistributionPoints {
-				fmt.Printf("CRLDistributionPoints[%d]: %s\n", i, value)
+// permanent reports whether the error is a 5xx reply of the server, which
+// another hop is not expected to change.
+func permanent(err error) bool {
+	var re recipientError
+	if errors.As(err, &re) {
+		return !re.temporary()
+	}
+	var te *textproto.Error
+	return errors.As(err, &te) && te.Code >= 500
+}
+
+// deliver sends the message through the hops of the account until it has been
+// delivered to every recipient.  When connecting to a hop fails, TLS fails or
+// the server answers with a 4xx reply the recipients that are left are tried
+// on the next hop, while a 5xx reply is final.  The results are those of
+// sendMail.
+func deliver(config gsmtpConfig, account, from string, to []string,
+	msg io.ReadSeeker) ([]rcptResult, error) {
+
+	var rejected, left []rcptResult
+	var err error
+	for _, h := range getHops(config, account) {
+		var r []rcptResult
+		r, err = sendMail(h.s, from, to, msg)
+		if err != nil {
+			log.Printf("Sending via %s (%s): %v", h.s.Addr, h.account, err)
+			if permanent(err) {
+				break
 			}
-			for i, value := range cert.IssuingCertificateURL {
-				fmt.Printf("IssuingCertificateURL[%d]: %s\n", i, value)
+			continue
+		}
+
+		var sent []string
+		left = nil
+		for _, addr := range to {
+			var result *rcptResult
+			for i := range r {
+				if r[i].addr == addr {
+					result = &r[i]
+				}
 			}
-			hash := sha256.New()
-			hash.Write(cert.Raw)
-			fingerprint := fmt.Sprintf("%X", hash.Sum(nil))
-			fmt.Printf("SHA-256 Fingerprint:\n %s\n", fingerprint)
-
-			pemBlock := pem.Block{
-				Type:  "CERTIFICATE",
-				Bytes: cert.Raw,
+
+			switch {
+			case result == nil:
+				sent = append(sent, addr)
+			case permanent(result.err):
+				rejected = append(rejected, *result)
+			default:
+				left = append(left, *result)
 			}
-			fmt.Print(string(pem.EncodeToMemory(&pemBlock)))
+		}
+		if len(sent) > 0 {
+			log.Printf("Sent to %s via %s (%s)", strings.Join(sent, ", "),
+				h.s.Addr, h.account)
+		}
 
-			fmt.Printf("\n")
+		to = nil
+		for _, r := range left {
+			to = append(to, r.addr)
+		}
+		if len(to) == 0 {
+			break
 		}
+	}
 
-		if err = c.Quit(); err != nil {
-			return err
+	if err != nil {
+		// Rejections by earlier hops still stand, but the recipients that
+		// are left failed with the last hop.
+		if len(rejected) == 0 && len(left) == 0 {
+			return nil, err
+		}
+		left = nil
+		for _, addr := range to {
+			left = append(left, rcptResult{addr, err})
 		}
+	}
+	return append(rejected, left...), nil
+}
 
-		fmt.Printf("------------------------------------------------------------------------\n\n\n")
+// rcptResult is a recipient together with the reply of the server to it.
+type rcptResult struct {
+	addr string
+	err  error
+}
+
+// recipientError reports the recipients the server rejected.
+type recipientError []rcptResult
+
+func (e recipientError) Error() string {
+	l := make([]string, len(e))
+	for i, r := range e {
+		l[i] = fmt.Sprintf("%s: %v", r.addr, r.err)
 	}
+	return "Rejected " + strings.Join(l, "; ")
+}
 
-	return nil
+// temporary reports whether the server rejected all of the recipients only
+// for now.
+func (e recipientError) temporary() bool {
+	for _, r := range e {
+		if exitCode(r.err) != exTempFail {
+			return false
+		}
+	}
+	return true
 }
 
 // sendMail was adapted from the net/smtp go standard library which is governed
 // by a BSD-style license.
 //
 // Copyright 2010 The Go Authors. All rights reserved.
-func sendMail(rootPEM string, addr string, auth smtp.Auth,
-	from string, to []string, msg []byte) error {
+//
+// Unlike smtp.SendMail it does not give up on the first recipient the server
+// rejects.  The message is delivered to the accepted recipients and the
+// rejected ones are returned, unless the server is configured with
+// requireAllRecipients, in which case a transaction with a rejected recipient
+// delivers nothing.  That holds only within one transaction: when the first one
+// fails this way the rejected recipients are returned as a recipientError, but
+// when an earlier one delivered the message the rejected recipients are
+// returned with their replies and the rest with a temporary error.  An error
+// means the message was delivered to none of the recipients.
+//
+// The recipients are split into mail transactions over the same connection
+// when there are more than maxRecipients of them or the server cuts a
+// transaction short with a 452 reply, and msg is read from the start for each
+// of them.
+func sendMail(s server, from string, to []string, msg io.ReadSeeker) ([]rcptResult, error) {
 
-	host, _, err := net.SplitHostPort(addr)
+	config, err := getTLSConfig(s)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	roots := x509.NewCertPool()
-	ok := roots.AppendCertsFromPEM([]byte(rootPEM))
-	if !ok {
-		return errors.New("Failed to parse root certificate")
-	}
+	ctx, cancel := serverContext(s)
+	defer cancel()
 
-	config := &tls.Config{
-		ServerName: host,
-		RootCAs:    roots,
+	c, err := dial(ctx, s, config)
+	if err != nil {
+		return nil, err
 	}
+	defer c.Close()
 
-	c, err := smtp.Dial(addr)
+	auth, err := getAuth(s, c)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if auth != nil {
+		if err = c.Auth(auth); err != nil {
+			return nil, err
+		}
 	}
-	defer c.Close()
 
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		if err = c.StartTLS(config); err != nil {
-			return err
+	limit := s.MaxRecipients
+	var rejected []rcptResult
+	var delivered bool
+	for len(to) > 0 {
+		tried, accepted, r, err := sendTransaction(c, s, from, to, limit, msg)
+		if err != nil {
+			if !delivered {
+				return nil, err
+			}
+			// The message went out in an earlier transaction, so the
+			// error only concerns the recipients that are left.  Under
+			// requireAllRecipients the rejected ones keep their own
+			// reply and the others are held back to be tried again.
+			var re recipientError
+			if !errors.As(err, &re) {
+				for _, addr := range to {
+					rejected = append(rejected, rcptResult{addr, err})
+				}
+				return rejected, nil
+			}
+			held := tempFailure(fmt.Errorf("Held back with rejected recipients: %v", err))
+			for _, addr := range to {
+				r := rcptResult{addr, held}
+				for _, rr := range re {
+					if rr.addr == addr {
+						r = rr
+					}
+				}
+				rejected = append(rejected, r)
+			}
+			return rejected, nil
 		}
-	} else {
-		err = errors.New("Server does not have the extension STARTTLS")
-		return err
+
+		if tried < len(to) && (limit == 0 || tried < limit) {
+			// The server replied 452 to one recipient too many, which
+			// it will do again in the following transactions.
+			log.Printf("Server takes %d recipients per message", tried)
+			limit = tried
+		}
+		rejected = append(rejected, r...)
+		delivered = delivered || accepted > 0
+		to = to[tried:]
 	}
 
-	if err = c.Auth(auth); err != nil {
-		return err
+	if !delivered {
+		return rejected, c.Quit()
+	}
+	// The message has been accepted at this point, so a failing QUIT must not
+	// make it look undelivered.
+	if err = c.Quit(); err != nil {
+		log.Printf("Warning: %v", err)
 	}
+	return rejected, nil
+}
+
+// sendTransaction delivers msg in a single mail transaction to the recipients
+// at the start of to, trying at most limit of them unless limit is 0.  A 452
+// reply after a recipient has been accepted ends the list of recipients, as
+// servers reply that way when a transaction has too many.  It returns the
+// number of recipients that were tried, how many of them were accepted and the
+// rejected ones.
+func sendTransaction(c *smtp.Client, s server, from string, to []string,
+	limit int, msg io.ReadSeeker) (tried, accepted int, rejected []rcptResult, err error) {
 
 	if err = c.Mail(from); err != nil {
-		return err
+		return 0, 0, nil, err
 	}
 	for _, addr := range to {
+		if limit > 0 && tried == limit {
+			break
+		}
 		if err = c.Rcpt(addr); err != nil {
-			return err
+			var te *textproto.Error
+			if !errors.As(err, &te) {
+				return 0, 0, nil, err
+			}
+			if te.Code == 452 && accepted > 0 {
+				break
+			}
+			rejected = append(rejected, rcptResult{addr, err})
+		} else {
+			accepted++
 		}
+		tried++
+	}
+
+	if len(rejected) > 0 && s.RequireAllRecipients {
+		return 0, 0, nil, recipientError(rejected)
+	}
+	if accepted == 0 {
+		return tried, 0, rejected, c.Reset()
+	}
+
+	if _, err = msg.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, nil, err
 	}
 	w, err := c.Data()
 	if err != nil {
-		return err
+		return 0, 0, nil, err
 	}
-	_, err = w.Write(msg)
-	if err != nil {
-		return err
+	// An error while copying returns without closing w so that the server
+	// never sees the end of a truncated message.
+	if _, err = io.Copy(w, msg); err != nil {
+		return 0, 0, nil, err
 	}
-	err = w.Close()
-	if err != nil {
-		return err
+	if err = w.Close(); err != nil {
+		return 0, 0, nil, err
 	}
-	return c.Quit()
+
+	return tried, accepted, rejected, nil
 }
 
 // LoginAuth was taken from
@@ -261,125 +1160,564 @@ func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
 	return nil, nil
 }
 
-func getAuth(s server) (smtp.Auth, error) {
+// negotiateAuth picks the first mechanism of preference that is in the list
+// of mechanisms advertised with the AUTH extension.
+func negotiateAuth(c *smtp.Client, preference []string) (string, error) {
+	ok, params := c.Extension("AUTH")
+	if !ok {
+		return "", permFailure(
+			errors.New("Server does not have the extension AUTH"))
+	}
+
+	offered := strings.Fields(strings.ToLower(params))
+	for _, mech := range preference {
+		for _, o := range offered {
+			if mech == o {
+				return mech, nil
+			}
+		}
+	}
+
+	return "", permFailure(
+		fmt.Errorf("No supported authentication mechanism in %q", params))
+}
+
+// getAuth returns the smtp.Auth for the server's auth setting, negotiating
+// the mechanism with the connected client if needed.  A nil smtp.Auth means
+// no authentication should be done.
+func getAuth(s server, c *smtp.Client) (smtp.Auth, error) {
+	mech := strings.ToLower(s.Auth)
+	switch mech {
+	case "", authAuto:
+		if !hasCredentials(s) {
+			return nil, nil
+		}
+		preference := authPreference
+		if hasOAuth(s) {
+			preference = oauthPreference
+		}
+		var err error
+		mech, err = negotiateAuth(c, preference)
+		if err != nil {
+			return nil, err
+		}
+	case authNone:
+		return nil, nil
+	case authPlain, authLogin, authCRAMMD5, authSCRAMSHA1, authSCRAMSHA256,
+		authXOAuth2, authOAuthBearer:
+	default:
+		return nil, fmt.Errorf("Unknown auth %q", s.Auth)
+	}
+
+	if mech == authXOAuth2 || mech == authOAuthBearer {
+		return getOAuth(s, mech)
+	}
 
+	if len(s.PassEval) == 0 {
+		return nil, errors.New("passwordeval is missing")
+	}
 	out, err := exec.Command(s.PassEval[0], s.PassEval[1:]...).Output()
 	if err != nil {
 		return nil, err
 	}
 	password := strings.TrimSpace(string(out))
 
-	auth := LoginAuth(s.Username, password)
+	switch mech {
+	case authPlain:
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return nil, err
+		}
+		return smtp.PlainAuth("", s.Username, password, host), nil
+	case authLogin:
+		return LoginAuth(s.Username, password), nil
+	case authSCRAMSHA1:
+		return ScramSHA1Auth(s.Username, password), nil
+	case authSCRAMSHA256:
+		return ScramSHA256Auth(s.Username, password), nil
+	default:
+		return smtp.CRAMMD5Auth(s.Username, password), nil
+	}
+}
+
+// getServerName selects the account for the sender in the From header, or
+// for the sender given with -f or -r if the message has no From header.  The
+// null sender <> selects no account.  Unless it is given with -account, it is
+// the first account in order of name whose from or aliases have the sender,
+// else the first with a match pattern for the sender and else the default,
+// unless rejectUnknownFrom is set and the From header has an unknown sender.
+// Addresses are compared ignoring case, and ignoring +tags only if no account
+// has the sender itself.
+func getServerName(config gsmtpConfig, from string) (string, error) {
+	if *accountFlag != "" {
+		return *accountFlag, nil
+	}
+
+	// The envelope sender may be a bounce address that differs from the
+	// sender in the header, like the ones of VERP, so it is only used when
+	// there is nothing else.
+	f := from
+	if f == "" {
+		f = strings.TrimSuffix(strings.TrimPrefix(senderFlag(), "<"), ">")
+	}
+	if f == "" {
+		return config.DefaultServer, nil
+	}
+
+	// An account that has the sender as it is wins over one that has it
+	// without its +tag.
+	sameAddress := []func(a, b string) bool{
+		strings.EqualFold,
+		func(a, b string) bool { return normalizeAddress(a) == normalizeAddress(b) },
+	}
+	names := serverNames(config)
+	for _, same := range sameAddress {
+		for _, name := range names {
+			s := config.Servers[name]
+			for _, addr := range append([]string{s.From}, s.Aliases...) {
+				if addr != "" && same(addr, f) {
+					return name, nil
+				}
+			}
+		}
+	}
+	for _, name := range names {
+		if matchAny(config.Servers[name].Match, f) {
+			return name, nil
+		}
+	}
+
+	if config.RejectUnknownFrom && from != "" {
+		return "", &exitError{exNoPerm,
+			fmt.Errorf("No account is configured for sender %s", from)}
+	}
+	return config.DefaultServer, nil
+}
 
-	//	host, _, err := net.SplitHostPort(s.Addr)
-	//	if err != nil {
-	//		return nil, err
-	//	}
-	// 	auth := smtp.PlainAuth("", s.Username, password, host)
+// senderFlag returns the envelope sender given with -f or -r.
+func senderFlag() string {
+	if *fromFlag != "" {
+		return *fromFlag
+	}
+	return *rFlag
+}
 
-	return auth, nil
+// envelopeFrom returns the envelope sender to send the message through the
+// account with: the one given with -f or -r, else the envelopeFrom of the
+// account and else the address in the From header.  An empty address, written
+// as <>, is the null sender used for bounces.
+func envelopeFrom(s server, from string) string {
+	sender := senderFlag()
+	if sender == "" {
+		sender = s.EnvelopeFrom
+	}
+	if sender == "" {
+		return from
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(sender, "<"), ">")
 }
 
-func getServerName(config gsmtpConfig, from string) string {
-	n := *accountFlag
-	if n == "" {
-		n = config.DefaultServer
-		f := ""
-		if *fromFlag != "" {
-			f = *fromFlag
-		} else {
-			f = from
+// parseArgs parses the recipients given as arguments.  An argument may hold a
+// comma separated list of addresses and, as with sendmail, local names without
+// a domain are passed on as they are.
+func parseArgs(args []string) []string {
+	var to []string
+	for _, arg := range args {
+		if al, err := mail.ParseAddressList(arg); err == nil {
+			for _, a := range al {
+				to = append(to, a.Address)
+			}
+			continue
 		}
-		for name, s := range config.Servers {
-			if strings.Compare(s.From, f) == 0 {
-				n = name
-				break
+		for _, a := range strings.Split(arg, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				to = append(to, a)
 			}
 		}
 	}
-	return n
+	return to
 }
 
-func parseMail(r io.Reader) (string, []string, []byte, error) {
-	m, err := mail.ReadMessage(r)
-	if err != nil {
-		return "", nil, nil, err
+// getRecipients returns the envelope recipients with the semantics of
+// sendmail.  With -t they are the recipients from the headers except for the
+// ones given as arguments, otherwise they are the arguments.  Without -t and
+// arguments the headers are used as well, as gsmtp always did.
+func getRecipients(headers []string, args []string) ([]string, error) {
+	argv := parseArgs(args)
+
+	to := argv
+	if *extractFlag || len(argv) == 0 {
+		skip := make(map[string]bool)
+		if *extractFlag {
+			for _, a := range argv {
+				skip[strings.ToLower(a)] = true
+			}
+		}
+
+		to = nil
+		for _, h := range headers {
+			if !skip[strings.ToLower(h)] {
+				to = append(to, h)
+			}
+		}
 	}
 
-	// Parse the from address
-	f, err := mail.ParseAddress(m.Header.Get("From"))
-	if err != nil {
-		return "", nil, nil, err
+	if len(to) == 0 {
+		return nil, usageError(errors.New("No recipients"))
 	}
-	from := f.Address
+	return to, nil
+}
 
-	// Build a list of names to send email to
-	l := ""
-	for k, v := range m.Header {
-		if "To" == k || "Cc" == k || "Bcc" == k {
-			if l == "" {
-				l = strings.Join(v, ",")
-			} else {
-				l += ", " + strings.Join(v, ",")
+// dotReader ends the message at a line holding a single dot, as sendmail does
+// unless it is run with -i.
+type dotReader struct {
+	r    *bufio.Reader
+	line []byte
+	bol  bool
+	eof  bool
+}
+
+func newDotReader(r *bufio.Reader) *dotReader {
+	return &dotReader{r: r, bol: true}
+}
+
+func (d *dotReader) Read(p []byte) (int, error) {
+	for len(d.line) == 0 {
+		if d.eof {
+			return 0, io.EOF
+		}
+
+		// Lines longer than the buffer of the bufio.Reader are returned in
+		// pieces, only the first of which is at the beginning of a line.
+		line, err := d.r.ReadSlice('\n')
+		switch err {
+		case nil:
+		case bufio.ErrBufferFull:
+		case io.EOF:
+			d.eof = true
+		default:
+			return 0, err
+		}
+
+		if d.bol {
+			switch string(line) {
+			case ".\n", ".\r\n":
+				d.eof = true
+				return 0, io.EOF
+			case ".":
+				if d.eof {
+					return 0, io.EOF
+				}
 			}
 		}
+
+		d.bol = len(line) > 0 && line[len(line)-1] == '\n'
+		d.line = line
 	}
 
-	// Parse the to addresses
-	tal, err := mail.ParseAddressList(l)
-	if err != nil {
-		return "", nil, nil, err
+	n := copy(p, d.line)
+	d.line = d.line[n:]
+	return n, nil
+}
+
+// headerField is a header field exactly as it was read, including its
+// continuation lines and line endings.
+type headerField struct {
+	name string
+	raw  []byte
+}
+
+// readHeader reads the header fields of the message up to and including the
+// empty line separating them from the body, which is returned as sep.  As with
+// sendmail the header also ends at the first line that is neither a header
+// field nor a continuation line, which is returned in sep after an empty line
+// so that it starts the body.  A message that does not start with a header
+// field has none.
+func readHeader(r *bufio.Reader) ([]headerField, []byte, error) {
+	var fields []headerField
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return fields, line, nil
+		}
+
+		i := bytes.IndexByte(line, ':')
+		switch {
+		case (line[0] == ' ' || line[0] == '\t') && len(fields) > 0:
+			last := &fields[len(fields)-1]
+			last.raw = append(last.raw, line...)
+		case i >= 0 && validFieldName(line[:i]):
+			name := string(bytes.TrimRight(line[:i], " \t"))
+			fields = append(fields, headerField{name, line})
+		default:
+			// Output of scripts often has no header at all, or runs
+			// into text after a line that looks like one, so the rest
+			// is body, separated from the fields by an empty line.
+			eol := "\n"
+			if bytes.HasSuffix(line, []byte("\r\n")) {
+				eol = "\r\n"
+			}
+			return fields, append([]byte(eol), line...), nil
+		}
+
+		if err == io.EOF {
+			return fields, nil, nil
+		}
+	}
+}
+
+// message is a message with its header fields read and its body still to be
+// read.
+type message struct {
+	from   string        // the address in the From header
+	to     []string      // the addresses in the To, Cc and Bcc headers
+	fields []headerField // the header fields to send, without Bcc
+	sep    []byte        // the empty line after the header fields
+	body   io.Reader
+}
+
+// eol returns the line ending the message uses.
+func (m *message) eol() string {
+	if bytes.HasSuffix(m.sep, []byte("\r\n")) ||
+		(len(m.fields) > 0 && bytes.HasSuffix(m.fields[0].raw, []byte("\r\n"))) {
+		return "\r\n"
 	}
-	to := make([]string, len(tal))
-	for i, t := range tal {
-		to[i] = t.Address
+	return "\n"
+}
+
+// addField returns the fields with a new field appended.
+func (m *message) addField(fields []headerField, name, value string) []headerField {
+	eol := m.eol()
+	fields = append([]headerField(nil), fields...)
+
+	// A message without a body may end without a line break.
+	if n := len(fields); n > 0 && !bytes.HasSuffix(fields[n-1].raw, []byte("\n")) {
+		raw := append([]byte(nil), fields[n-1].raw...)
+		fields[n-1] = headerField{fields[n-1].name, append(raw, eol...)}
 	}
 
-	// Build the email to send (with the Bcc headers removed)
-	var msg bytes.Buffer
-	for k, v := range m.Header {
-		if "Bcc" != k {
-			for _, h := range v {
-				_, err := msg.WriteString(fmt.Sprintf("%s: %s\n", k, h))
-				if err != nil {
-					return "", nil, nil, err
-				}
+	return append(fields, headerField{name, []byte(name + ": " + value + eol)})
+}
+
+// hasField reports whether the message has a header field with the name.
+func (m *message) hasField(name string) bool {
+	for _, f := range m.fields {
+		if strings.EqualFold(f.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// header returns the header fields followed by the empty line ending them.
+func (m *message) header(fields []headerField) []byte {
+	var buf bytes.Buffer
+	for _, f := range fields {
+		buf.Write(f.raw)
+	}
+	buf.Write(m.sep)
+	return buf.Bytes()
+}
+
+// senderFields returns the header fields to send the message through the
+// account with, applying its senderHeader policy for the envelope sender.
+func senderFields(s server, m *message, sender string) []headerField {
+	if sender == "" || strings.EqualFold(sender, m.from) {
+		return m.fields
+	}
+
+	switch s.SenderHeader {
+	case senderAdd:
+		for _, f := range m.fields {
+			if strings.EqualFold(f.name, "Sender") {
+				return m.fields
 			}
 		}
+		return m.addField(m.fields, "Sender", "<"+sender+">")
+
+	case senderReplace:
+		var fields []headerField
+		for _, f := range m.fields {
+			if !strings.EqualFold(f.name, "Sender") {
+				fields = append(fields, f)
+			}
+		}
+		return m.addField(fields, "Sender", "<"+sender+">")
+	}
+
+	return m.fields
+}
+
+// completeHeader adds the From, Date and Message-ID fields RFC 5322 requires
+// when the message lacks them.  The From field has the from of the account,
+// or only if it has none the sender given with -f or -r, which may be a bounce
+// address, with the name given with -F.  The Message-ID is in the
+// messageIdDomain of the account or else the domain of the sender.
+func completeHeader(m *message, s server) error {
+	if !m.hasField("From") {
+		addr := s.From
+		if addr == "" {
+			addr = strings.TrimSuffix(strings.TrimPrefix(senderFlag(), "<"), ">")
+		}
+		if addr == "" {
+			return errors.New("Message has no From header and no sender is known")
+		}
+		from := mail.Address{Name: *fullNameFlag, Address: addr}
+		m.from = addr
+		m.fields = m.addField(m.fields, "From", from.String())
+	}
+
+	if !m.hasField("Date") {
+		m.fields = m.addField(m.fields, "Date", time.Now().Format(time.RFC1123Z))
+	}
+
+	if !m.hasField("Message-ID") {
+		domain := s.MessageIDDomain
+		if at := strings.LastIndex(m.from, "@"); domain == "" && at >= 0 {
+			domain = m.from[at+1:]
+		}
+		if domain == "" {
+			domain = localFQDN(context.Background())
+		}
+
+		id := make([]byte, 12)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		m.fields = m.addField(m.fields, "Message-ID",
+			fmt.Sprintf("<%d.%x@%s>", time.Now().Unix(), id, domain))
+	}
+
+	return nil
+}
+
+// validFieldName reports whether the name, which may be followed by white
+// space, is a valid header field name.
+func validFieldName(name []byte) bool {
+	name = bytes.TrimRight(name, " \t")
+	if len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		if c < 33 || c > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMail reads the header of the message and parses the sender and the
+// recipients from it.  A message without a From header has an empty sender.
+// The message is passed on byte for byte except for the Bcc header fields
+// which are left out.  Only the header is buffered, the body is read from r
+// while the message is spooled.
+func parseMail(r io.Reader) (*message, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
 	}
-	_, err = msg.WriteString("\n")
+
+	fields, sep, err := readHeader(br)
 	if err != nil {
-		return "", nil, nil, err
+		return nil, err
+	}
+
+	// Parse the header with net/mail from a copy of the fields
+	var raw bytes.Buffer
+	for _, f := range fields {
+		raw.Write(f.raw)
 	}
-	_, err = msg.ReadFrom(m.Body)
+	raw.WriteString("\r\n")
+	m, err := mail.ReadMessage(&raw)
 	if err != nil {
-		return "", nil, nil, err
+		return nil, err
+	}
+
+	// Parse the from address
+	var from string
+	if _, ok := m.Header["From"]; ok {
+		f, err := mail.ParseAddress(m.Header.Get("From"))
+		if err != nil {
+			return nil, err
+		}
+		from = f.Address
+	}
+
+	// Build a list of names to send email to
+	var l []string
+	for _, k := range []string{"To", "Cc", "Bcc"} {
+		l = append(l, m.Header[k]...)
+	}
+
+	// Parse the to addresses
+	var to []string
+	if len(l) > 0 {
+		tal, err := mail.ParseAddressList(strings.Join(l, ", "))
+		if err != nil {
+			return nil, err
+		}
+		to = make([]string, len(tal))
+		for i, t := range tal {
+			to[i] = t.Address
+		}
 	}
 
-	return from, to, msg.Bytes(), err
+	// Keep the header fields to send (with the Bcc fields removed)
+	var send []headerField
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, "Bcc") {
+			send = append(send, f)
+		}
+	}
+
+	// The body is not read here but streamed to the queue.
+	return &message{from, to, send, sep, br}, nil
 }
 
 func main() {
-	flag.Parse()
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(exOK)
+		}
+		os.Exit(exUsage)
+	}
+
+	// Like sendmail gsmtp lists the queue when it is invoked as mailq.
+	if strings.TrimSuffix(path.Base(os.Args[0]), ".exe") == "mailq" {
+		*listQueueFlag = true
+	}
 
 	logFile, err := os.OpenFile(*logFileFlag, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "gsmtp: %v\n", err)
+		os.Exit(exCantCreat)
 	}
 	log.SetOutput(logFile)
 
-	if len(flag.Args()) > 0 {
-		log.Printf("Warning: unused arguments %v\n", flag.Args())
+	if *listQueueFlag {
+		if err := listQueue(*queueDirFlag); err != nil {
+			fail(err)
+		}
+		os.Exit(exOK)
 	}
 
 	configToml, err := ioutil.ReadFile(*configFileFlag)
 	if err != nil {
-		log.Panic(err)
+		fail(configError(err))
 	}
 
 	var config gsmtpConfig
 	if _, err := toml.Decode(string(configToml), &config); err != nil {
-		log.Panic(err)
+		fail(configError(err))
+	}
+
+	if err := validateConfig(config); err != nil {
+		fail(configError(err))
 	}
 
 	if *debugFlag {
@@ -390,38 +1728,160 @@ func main() {
 	if *serverinfoFlag {
 		err := printServerInfo(config)
 		if err != nil {
-			log.Panic(err)
+			fail(err)
 		} else {
 			log.Println("Got server info")
-			os.Exit(0)
+			os.Exit(exOK)
 		}
 	}
 
-	r := bufio.NewReader(os.Stdin)
-	from, to, msg, err := parseMail(r)
-	if err != nil {
-		log.Panic(err)
+	if *pinFlag != "" {
+		err := pinServer(config, *pinFlag)
+		if err != nil {
+			fail(err)
+		} else {
+			log.Printf("Pinned certificate for %s", *pinFlag)
+			os.Exit(exOK)
+		}
+	}
+
+	if *deleteFlag != "" || *holdFlag != "" || *releaseFlag != "" ||
+		*retryFlag != "" {
+		var err error
+		switch {
+		case *deleteFlag != "":
+			err = deleteQueued(*queueDirFlag, strings.ToUpper(*deleteFlag))
+		case *holdFlag != "":
+			err = holdQueued(*queueDirFlag, strings.ToUpper(*holdFlag), true)
+		case *releaseFlag != "":
+			err = holdQueued(*queueDirFlag, strings.ToUpper(*releaseFlag), false)
+		default:
+			err = retryQueued(config, *queueDirFlag, strings.ToUpper(*retryFlag))
+		}
+		if err != nil {
+			fail(err)
+		}
+		os.Exit(exOK)
+	}
+
+	if *queueFlag {
+		err := runQueue(config, *queueDirFlag)
+		if err != nil {
+			fail(err)
+		} else {
+			os.Exit(exOK)
+		}
 	}
 
-	sn := getServerName(config, from)
-	s := config.Servers[sn]
-	auth, err := getAuth(s)
+	stdin := bufio.NewReader(os.Stdin)
+	var r io.Reader = stdin
+	if !*ignoreDotsFlag && !*oiFlag {
+		r = newDotReader(stdin)
+	}
+	m, err := parseMail(r)
 	if err != nil {
-		log.Panic(err)
+		fail(dataError(err))
 	}
 
-	if *debugFlag {
-		println("Selected Account:", sn)
-		println("Auth:", auth)
-		println("Send email from:", from)
-		println("Send email to:", strings.Join(to, ", "))
-		fmt.Printf("Mail:\"\"\"\n%s\"\"\"\n", string(msg))
+	to, err := getRecipients(m.to, flag.Args())
+	if err != nil {
+		fail(err)
 	}
 
-	err = sendMail(s.RootPEM, s.Addr, auth, from, to, msg)
+	sn, err := getServerName(config, m.from)
 	if err != nil {
-		log.Panic(err)
+		fail(err)
+	}
+	if s, ok := config.Servers[sn]; ok {
+		if err := completeHeader(m, s); err != nil {
+			fail(dataError(err))
+		}
+	}
+
+	routes := getRoutes(config, sn, to)
+	for _, r := range routes {
+		s, ok := config.Servers[r.account]
+		if !ok {
+			fail(configError(fmt.Errorf("Unknown account %q", r.account)))
+		}
+
+		if *debugFlag {
+			println("Selected Account:", r.account)
+			println("Auth:", s.Auth)
+			println("Send email from:", envelopeFrom(s, m.from))
+			println("Send email to:", strings.Join(r.to, ", "))
+		}
+	}
+
+	// The message is spooled to the queue before it is sent so that it is
+	// not lost if it cannot be delivered right away.  Recipients routed
+	// through different accounts get an entry each, with the header for the
+	// account and the body copied from the first entry.
+	envs := make([]envelope, len(routes))
+	ids := make([]string, len(routes))
+	var bodyStart int64
+	for i, r := range routes {
+		s := config.Servers[r.account]
+		sender := envelopeFrom(s, m.from)
+		header := m.header(senderFields(s, m, sender))
+
+		envs[i] = envelope{
+			From:    sender,
+			To:      r.to,
+			Account: r.account,
+			Created: time.Now(),
+		}
+		if i == 0 {
+			ids[i], err = enqueue(*queueDirFlag, envs[i],
+				io.MultiReader(bytes.NewReader(header), m.body))
+			bodyStart = int64(len(header))
+		} else {
+			ids[i], err = enqueueCopy(*queueDirFlag, ids[0], bodyStart,
+				envs[i], header)
+		}
+		if err != nil {
+			// The caller is told that the message was not accepted, so
+			// the entries queued for it so far must not be sent.
+			dropEntries(*queueDirFlag, ids[:i])
+			fail(&exitError{exCantCreat, err})
+		}
+	}
+
+	// Signing adds a field to the start of the message, so it waits until
+	// the body has been copied from the first entry.
+	for i, r := range routes {
+		s := config.Servers[r.account]
+		if !hasDKIM(s) {
+			continue
+		}
+		if err := signEntry(*queueDirFlag, ids[i], s); err != nil {
+			dropEntries(*queueDirFlag, ids)
+			if _, ok := err.(*exitError); !ok {
+				err = &exitError{exCantCreat, err}
+			}
+			fail(fmt.Errorf("Signing for %s: %w", r.account, err))
+		}
+	}
+
+	// Messages that fail for good are not kept in the queue, since the
+	// caller still has them and is told they were not sent.
+	var failures []error
+	for i, id := range ids {
+		deferred, failed := processEntry(config, *queueDirFlag, id, envs[i], false)
+		unlockEntry(*queueDirFlag, id)
+
+		if deferred != nil {
+			fmt.Fprintf(os.Stderr, "gsmtp: queued as %s: %v\n", id, deferred)
+		}
+		if failed != nil {
+			failures = append(failures, failed)
+		}
 	}
 
-	log.Printf("[SENT] from:%s to:%s", from, strings.Join(to, ", "))
+	if len(failures) > 0 {
+		for _, err := range failures[1:] {
+			fmt.Fprintf(os.Stderr, "gsmtp: %v\n", err)
+		}
+		fail(failures[0])
+	}
 }
@@ -0,0 +1,1243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// fakeServer is an SMTP server for the tests.  It offers STARTTLS with a
+// self-signed certificate for 127.0.0.1 and records the transactions it
+// receives.
+type fakeServer struct {
+	l       net.Listener
+	key     *ecdsa.PrivateKey
+	cert    *x509.Certificate
+	certPEM string
+
+	// ext are EHLO keywords offered in addition to STARTTLS.
+	ext []string
+	// rcpt returns the reply to the nth RCPT of a transaction, or "" to
+	// accept it.
+	rcpt func(n int, addr string) string
+	// auth handles an AUTH command and writes the replies itself.
+	auth func(c *textproto.Conn, line string)
+
+	mu       sync.Mutex
+	config   *tls.Config
+	implicit bool // whether TLS is spoken from the start
+	msgs     []fakeMessage
+	cmds     []string
+}
+
+// fakeMessage is a mail transaction received by a fakeServer.
+type fakeMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// newFakeServer starts a fakeServer that is closed with the test.
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gsmtp test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeServer{
+		l:       l,
+		key:     key,
+		cert:    cert,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		config: &tls.Config{Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}}},
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// useChain has the server present a certificate for 127.0.0.1 issued by its
+// self-signed one, followed by the self-signed one, and returns the new
+// certificate.
+func (f *fakeServer) useChain(t *testing.T) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gsmtp test leaf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, f.cert, &key.PublicKey, f.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	f.config = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{der, f.cert.Raw},
+		PrivateKey:  key,
+	}}}
+	f.mu.Unlock()
+	return leaf
+}
+
+// useImplicitTLS has the server speak TLS from the start instead of offering
+// STARTTLS.
+func (f *fakeServer) useImplicitTLS() {
+	f.mu.Lock()
+	f.implicit = true
+	f.mu.Unlock()
+}
+
+// addr returns the address the server listens on.
+func (f *fakeServer) addr() string {
+	return f.l.Addr().String()
+}
+
+// server returns the settings of an account for the server.
+func (f *fakeServer) server() server {
+	return server{
+		Addr:           f.addr(),
+		Helo:           "client.example.com",
+		RootPEM:        f.certPEM,
+		ConnectTimeout: duration(5 * time.Second),
+		CommandTimeout: duration(5 * time.Second),
+		TotalTimeout:   duration(10 * time.Second),
+	}
+}
+
+// messages returns the transactions the server received.
+func (f *fakeServer) messages() []fakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeMessage(nil), f.msgs...)
+}
+
+// commands returns the commands the server received.
+func (f *fakeServer) commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.cmds...)
+}
+
+func (f *fakeServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	f.mu.Lock()
+	config, secure := f.config, f.implicit
+	f.mu.Unlock()
+
+	if secure {
+		tlsConn := tls.Server(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		conn = tlsConn
+	}
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 fake.example.com ESMTP")
+
+	var tx *fakeMessage
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.cmds = append(f.cmds, line)
+		f.mu.Unlock()
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(line[len(verb):])
+		switch verb {
+		case "EHLO", "HELO":
+			ext := f.ext
+			if !secure {
+				ext = append([]string{"STARTTLS"}, ext...)
+			}
+			var buf strings.Builder
+			buf.WriteString("250-fake.example.com\r\n")
+			for _, e := range ext {
+				buf.WriteString("250-" + e + "\r\n")
+			}
+			buf.WriteString("250 8BITMIME")
+			c.PrintfLine("%s", buf.String())
+		case "STARTTLS":
+			c.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, config)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			c = textproto.NewConn(conn)
+			secure = true
+		case "AUTH":
+			if f.auth == nil {
+				c.PrintfLine("504 Unrecognized authentication type")
+				continue
+			}
+			f.auth(c, line)
+		case "MAIL":
+			// The parameters after the address are left out.
+			from, _, _ := strings.Cut(strings.TrimPrefix(arg, "FROM:"), " ")
+			tx = &fakeMessage{from: from}
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			addr, _, _ := strings.Cut(strings.TrimPrefix(arg, "TO:"), " ")
+			reply := ""
+			if f.rcpt != nil {
+				reply = f.rcpt(len(tx.to), addr)
+			}
+			if reply == "" || reply[0] == '2' {
+				tx.to = append(tx.to, addr)
+			}
+			if reply == "" {
+				reply = "250 OK"
+			}
+			c.PrintfLine("%s", reply)
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			tx.data = string(data)
+			f.mu.Lock()
+			f.msgs = append(f.msgs, *tx)
+			f.mu.Unlock()
+			tx = nil
+			c.PrintfLine("250 Queued")
+		case "RSET":
+			tx = nil
+			c.PrintfLine("250 OK")
+		case "NOOP":
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("500 Unknown command")
+		}
+	}
+}
+
+const sampleConfig = `default = "home"
+queueMaxAge = "72h0m0s"
+
+[servers.home]
+address = "smtp.example.com:587"
+from = "lcw@example.com"
+aliases = ["lcw@example.net"]
+username = "lcw"
+passwordeval = ["pass", "smtp/home"]
+commandTimeout = "2m0s"
+
+[servers.relay]
+address = "relay.example.com:25"
+addresses = ["relay2.example.com:25"]
+matchRecipients = ["@corp.example.com"]
+auth = "none"
+
+[servers.work]
+address = "PLACEHOLDER"
+helo = "client.example.com"
+from = "lcw@corp.example.com"
+tokenURL = "https://oauth.example.com/token"
+clientID = "gsmtp"
+refreshtokeneval = ["pass", "smtp/work"]
+`
+
+func TestPinServer(t *testing.T) {
+	f := newFakeServer(t)
+
+	file := path.Join(t.TempDir(), "init.toml")
+	sample := strings.Replace(sampleConfig, "PLACEHOLDER", f.addr(), 1)
+	if err := ioutil.WriteFile(file, []byte(sample), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var before gsmtpConfig
+	if _, err := toml.Decode(sample, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(before); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(file string, yes bool) {
+		*configFileFlag, *yesFlag = file, yes
+	}(*configFileFlag, *yesFlag)
+	*configFileFlag, *yesFlag = file, true
+
+	var config gsmtpConfig
+	if _, err := toml.DecodeFile(file, &config); err != nil {
+		t.Fatal(err)
+	}
+	if err := pinServer(config, "work"); err != nil {
+		t.Fatal(err)
+	}
+
+	var after gsmtpConfig
+	if _, err := toml.DecodeFile(file, &after); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(after); err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := after.Servers["work"]
+	if pinned.RootPEM != f.certPEM {
+		t.Errorf("rootPEM = %q, want %q", pinned.RootPEM, f.certPEM)
+	}
+	want := []string{fingerprint(f.cert)}
+	if !reflect.DeepEqual(pinned.Fingerprints, want) {
+		t.Errorf("fingerprints = %q, want %q", pinned.Fingerprints, want)
+	}
+	pinned.RootPEM, pinned.Fingerprints = "", nil
+	if !reflect.DeepEqual(pinned, before.Servers["work"]) {
+		t.Errorf("pinned account = %+v, want %+v", pinned, before.Servers["work"])
+	}
+
+	for _, name := range []string{"home", "relay"} {
+		if !reflect.DeepEqual(after.Servers[name], before.Servers[name]) {
+			t.Errorf("account %s = %+v, want %+v", name, after.Servers[name],
+				before.Servers[name])
+		}
+	}
+	after.Servers, before.Servers = nil, nil
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("config = %+v, want %+v", after, before)
+	}
+
+	// Settings that are not set are not written as empty values.
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := bufio.NewScanner(strings.NewReader(string(data)))
+	for sc.Scan() {
+		if line := sc.Text(); strings.HasSuffix(line, `= ""`) ||
+			strings.HasSuffix(line, "= []") {
+			t.Errorf("Empty setting written: %s", line)
+		}
+	}
+}
+
+func TestWriteTOMLSymlink(t *testing.T) {
+	dir := t.TempDir()
+	dotfiles := path.Join(dir, "dotfiles")
+	if err := os.Mkdir(dotfiles, 0700); err != nil {
+		t.Fatal(err)
+	}
+	target := path.Join(dotfiles, "gsmtp.toml")
+	if err := ioutil.WriteFile(target, []byte("default = \"home\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := path.Join(dir, "init.toml")
+	if err := os.Symlink("dotfiles/gsmtp.toml", link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeTOML(link, gsmtpConfig{DefaultServer: "work"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Lstat(link); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("%s was replaced by a regular file", link)
+	}
+	var config gsmtpConfig
+	if _, err := toml.DecodeFile(target, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.DefaultServer != "work" {
+		t.Errorf("default = %q in the target, want %q", config.DefaultServer, "work")
+	}
+	for _, d := range []string{dir, dotfiles} {
+		files, err := ioutil.ReadDir(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), ".") {
+				t.Errorf("temporary file %s left in %s", f.Name(), d)
+			}
+		}
+	}
+}
+
+func TestDotReader(t *testing.T) {
+	long := strings.Repeat("x", 16)
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"a\nb", "a\nb"},
+		{"a\n.\nb\n", "a\n"},
+		{"a\r\n.\r\nb\r\n", "a\r\n"},
+		{".\n", ""},
+		{"a\n.", "a\n"},
+		{"a\n..\nb\n", "a\n..\nb\n"},
+		{"a\n. \nb\n", "a\n. \nb\n"},
+		{"a.\nb\n", "a.\nb\n"},
+		{"a\n.b\n", "a\n.b\n"},
+		// With a buffer of 16 bytes the line is read in pieces, the
+		// last of which is a dot but not at the beginning of a line.
+		{long + ".\nb\n", long + ".\nb\n"},
+		{long + "\r\n.\r\n", long + "\r\n"},
+		{long + long + "\n.\nb\n", long + long + "\n"},
+	}
+
+	for _, tt := range tests {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = newDotReader(
+				bufio.NewReaderSize(strings.NewReader(tt.in), 16))
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Errorf("%q: %v", tt.in, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("%q: read %q, want %q", tt.in, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestParseMail(t *testing.T) {
+	tests := []struct {
+		name     string
+		in, want string
+		from     string
+		to       []string
+	}{
+		{
+			"folded",
+			"From: Joe <joe@example.com>\nTo: a@example.com,\n\tb@example.com\n" +
+				"Subject:  folded \n   subject\t\nX-Empty:\n\nbody\n  indented\n",
+			"From: Joe <joe@example.com>\nTo: a@example.com,\n\tb@example.com\n" +
+				"Subject:  folded \n   subject\t\nX-Empty:\n\nbody\n  indented\n",
+			"joe@example.com",
+			[]string{"a@example.com", "b@example.com"},
+		},
+		{
+			"crlf",
+			"From: joe@example.com\r\nTo: a@example.com\r\nSubject: caf\xc3\xa9\r\n" +
+				"\r\nbody\r\nbare\nlf\r\n",
+			"From: joe@example.com\r\nTo: a@example.com\r\nSubject: caf\xc3\xa9\r\n" +
+				"\r\nbody\r\nbare\nlf\r\n",
+			"joe@example.com",
+			[]string{"a@example.com"},
+		},
+		{
+			"bcc",
+			"From: joe@example.com\r\nBcc: c@example.com\r\nTo: a@example.com\r\n" +
+				"bcc: d@example.com,\r\n e@example.com\r\nBCC: f@example.com\r\n" +
+				"Subject: x\r\n\r\nBcc: in the body\r\n",
+			"From: joe@example.com\r\nTo: a@example.com\r\n" +
+				"Subject: x\r\n\r\nBcc: in the body\r\n",
+			"joe@example.com",
+			[]string{"a@example.com", "c@example.com", "d@example.com",
+				"e@example.com", "f@example.com"},
+		},
+		{
+			"no from",
+			"To: a@example.com\n\nbody",
+			"To: a@example.com\n\nbody",
+			"",
+			[]string{"a@example.com"},
+		},
+		{
+			"ends in header",
+			"From: joe@example.com\nTo: a@example.com\n",
+			"From: joe@example.com\nTo: a@example.com\n",
+			"joe@example.com",
+			[]string{"a@example.com"},
+		},
+		{
+			"ends in header without line break",
+			"From: joe@example.com\nTo: a@example.com,\n b@example.com",
+			"From: joe@example.com\nTo: a@example.com,\n b@example.com",
+			"joe@example.com",
+			[]string{"a@example.com", "b@example.com"},
+		},
+		{
+			"ends in header after bcc",
+			"To: a@example.com\nBcc: c@example.com",
+			"To: a@example.com\n",
+			"",
+			[]string{"a@example.com", "c@example.com"},
+		},
+		{
+			"no header",
+			"just text\nmore text\n",
+			"\njust text\nmore text\n",
+			"",
+			nil,
+		},
+		{
+			"no header crlf",
+			"just text\r\n",
+			"\r\njust text\r\n",
+			"",
+			nil,
+		},
+		{
+			"empty",
+			"",
+			"",
+			"",
+			nil,
+		},
+		{
+			"text after a field",
+			"Error: disk full\nsecond line\n",
+			"Error: disk full\n\nsecond line\n",
+			"",
+			nil,
+		},
+		{
+			"text in the header",
+			"To: a@example.com\r\n[cron] output\r\nFrom: joe@example.com\r\n",
+			"To: a@example.com\r\n\r\n[cron] output\r\nFrom: joe@example.com\r\n",
+			"",
+			[]string{"a@example.com"},
+		},
+		{
+			"invalid field name",
+			"From: joe@example.com\nBad Name: x\n\nbody\n",
+			"From: joe@example.com\n\nBad Name: x\n\nbody\n",
+			"joe@example.com",
+			nil,
+		},
+		{
+			"leading white space",
+			"  indented\nFrom: joe@example.com\n",
+			"\n  indented\nFrom: joe@example.com\n",
+			"",
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		m, err := parseMail(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		body, err := ioutil.ReadAll(m.body)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := string(m.header(m.fields)) + string(body); got != tt.want {
+			t.Errorf("%s: message = %q, want %q", tt.name, got, tt.want)
+		}
+		if m.from != tt.from {
+			t.Errorf("%s: from = %q, want %q", tt.name, m.from, tt.from)
+		}
+		if !reflect.DeepEqual(m.to, tt.to) {
+			t.Errorf("%s: to = %q, want %q", tt.name, m.to, tt.to)
+		}
+	}
+}
+
+func TestGetRecipients(t *testing.T) {
+	headers := []string{"a@example.com", "B@Example.com", "c@example.com"}
+	tests := []struct {
+		name    string
+		extract bool // -t
+		headers []string
+		args    []string
+		want    []string // or nil for an error
+	}{
+		{"arguments", false, headers, []string{"d@example.com"},
+			[]string{"d@example.com"}},
+		{"headers without arguments", false, headers, nil, headers},
+		{"-t", true, headers, nil, headers},
+		{"-t without the arguments", true, headers,
+			[]string{"b@example.com", "Joe <C@EXAMPLE.COM>"},
+			[]string{"a@example.com"}},
+		{"-t with other arguments", true, headers, []string{"d@example.com"}, headers},
+		{"comma list", false, nil, []string{"a@example.com, Joe <b@example.com>"},
+			[]string{"a@example.com", "b@example.com"}},
+		{"several arguments", false, nil,
+			[]string{"a@example.com", "b@example.com,c@example.com"},
+			[]string{"a@example.com", "b@example.com", "c@example.com"}},
+		{"local name", false, nil, []string{"root"}, []string{"root"}},
+		{"local names in a list", false, nil,
+			[]string{"root, joe@example.com,postmaster"},
+			[]string{"root", "joe@example.com", "postmaster"}},
+		{"-t without local name", true, []string{"root", "joe@example.com"},
+			[]string{"ROOT"}, []string{"joe@example.com"}},
+		{"none", false, nil, nil, nil},
+		{"-t with all excluded", true, headers[:1], []string{"A@example.com"}, nil},
+		{"empty argument", false, nil, []string{" , "}, nil},
+	}
+
+	defer func(extract bool) { *extractFlag = extract }(*extractFlag)
+	for _, tt := range tests {
+		*extractFlag = tt.extract
+		got, err := getRecipients(tt.headers, tt.args)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: recipients %q, want an error", tt.name, got)
+			} else if exitCode(err) != exUsage {
+				t.Errorf("%s: exit code %d, want %d", tt.name, exitCode(err), exUsage)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: recipients %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSendMail(t *testing.T) {
+	to := []string{"a@example.com", "b@example.com", "c@example.com",
+		"d@example.com", "e@example.com"}
+	const msg = "Subject: test\n\nbody\n"
+
+	tests := []struct {
+		name string
+		// rcpt is the reply to the nth recipient a transaction accepted
+		// so far, or "" to accept it.
+		rcpt          func(n int, addr string) string
+		maxRecipients int
+		requireAll    bool
+
+		msgs     [][]string // the recipients of each transaction
+		rejected []string   // the rejected recipients with their code or held
+		err      string     // the start of the error
+	}{
+		{
+			name: "all accepted",
+			msgs: [][]string{to},
+		},
+		{
+			name: "452 after two",
+			rcpt: func(n int, addr string) string {
+				if n == 2 {
+					return "452 4.5.3 Too many recipients"
+				}
+				return ""
+			},
+			msgs: [][]string{to[:2], to[2:4], to[4:]},
+		},
+		{
+			name:          "maxRecipients",
+			maxRecipients: 3,
+			msgs:          [][]string{to[:3], to[3:]},
+		},
+		{
+			name: "mixed",
+			rcpt: func(n int, addr string) string {
+				switch addr {
+				case "<b@example.com>":
+					return "550 5.1.1 No such user"
+				case "<c@example.com>":
+					return "451 4.3.0 Try again later"
+				}
+				return ""
+			},
+			msgs:     [][]string{{to[0], to[3], to[4]}},
+			rejected: []string{"b@example.com 550", "c@example.com 451"},
+		},
+		{
+			name: "mixed with 452",
+			rcpt: func(n int, addr string) string {
+				switch {
+				case addr == "<a@example.com>":
+					return "550 5.1.1 No such user"
+				case n == 2:
+					return "452 4.5.3 Too many recipients"
+				}
+				return ""
+			},
+			msgs:     [][]string{to[1:3], to[3:]},
+			rejected: []string{"a@example.com 550"},
+		},
+		{
+			name: "first 452",
+			rcpt: func(n int, addr string) string {
+				return "452 4.3.1 Insufficient system storage"
+			},
+			rejected: []string{"a@example.com 452", "b@example.com 452",
+				"c@example.com 452", "d@example.com 452", "e@example.com 452"},
+		},
+		{
+			name: "requireAllRecipients",
+			rcpt: func(n int, addr string) string {
+				if addr == "<d@example.com>" {
+					return "550 5.1.1 No such user"
+				}
+				return ""
+			},
+			requireAll: true,
+			err:        "Rejected d@example.com: 550",
+		},
+		{
+			name: "requireAllRecipients with maxRecipients",
+			rcpt: func(n int, addr string) string {
+				if addr == "<d@example.com>" {
+					return "550 5.1.1 No such user"
+				}
+				return ""
+			},
+			maxRecipients: 3,
+			requireAll:    true,
+			msgs:          [][]string{to[:3]},
+			rejected:      []string{"d@example.com 550", "e@example.com held"},
+		},
+		{
+			name:       "requireAllRecipients accepted",
+			requireAll: true,
+			msgs:       [][]string{to},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeServer(t)
+			f.rcpt = tt.rcpt
+			s := f.server()
+			s.MaxRecipients = tt.maxRecipients
+			s.RequireAllRecipients = tt.requireAll
+
+			results, err := sendMail(s, "joe@example.com", to,
+				strings.NewReader(msg))
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %s", err, tt.err)
+				}
+				if _, ok := err.(recipientError); !ok {
+					t.Errorf("error is %T, want recipientError", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			var rejected []string
+			for _, r := range results {
+				var te *textproto.Error
+				if !errors.As(r.err, &te) {
+					if exitCode(r.err) != exTempFail || permanent(r.err) {
+						t.Errorf("%s: %v is not a reply", r.addr, r.err)
+					}
+					rejected = append(rejected, r.addr+" held")
+					continue
+				}
+				rejected = append(rejected, fmt.Sprintf("%s %d", r.addr, te.Code))
+				if permanent(r.err) != (te.Code >= 500) {
+					t.Errorf("%s: permanent(%v) = %v", r.addr, r.err, permanent(r.err))
+				}
+			}
+			if !reflect.DeepEqual(rejected, tt.rejected) {
+				t.Errorf("rejected = %q, want %q", rejected, tt.rejected)
+			}
+
+			msgs := f.messages()
+			var got [][]string
+			for _, m := range msgs {
+				if m.from != "<joe@example.com>" {
+					t.Errorf("from = %s, want <joe@example.com>", m.from)
+				}
+				if m.data != msg {
+					t.Errorf("data = %q, want %q", m.data, msg)
+				}
+				var rcpts []string
+				for _, addr := range m.to {
+					rcpts = append(rcpts, strings.Trim(addr, "<>"))
+				}
+				got = append(got, rcpts)
+			}
+			if !reflect.DeepEqual(got, tt.msgs) {
+				t.Errorf("transactions = %q, want %q", got, tt.msgs)
+			}
+		})
+	}
+}
+
+func TestGetServerName(t *testing.T) {
+	config := gsmtpConfig{
+		DefaultServer: "home",
+		Servers: map[string]server{
+			"a-plain": {From: "lcw@example.com"},
+			"b-lists": {From: "lcw+lists@example.com"},
+			"c-alias": {From: "work@corp.example.com",
+				Aliases: []string{"LCW@Example.net"}},
+			"d-match": {Match: []string{"@corp.example.com", "/^sales\\W/"}},
+			"home":    {},
+		},
+	}
+
+	tests := []struct {
+		from   string // the sender in the From header
+		sender string // the sender given with -f
+		reject bool   // rejectUnknownFrom
+		want   string // the account, or "" for an error
+	}{
+		{"lcw@example.com", "", false, "a-plain"},
+		{"LCW@EXAMPLE.COM", "", false, "a-plain"},
+		{"lcw+lists@example.com", "", false, "b-lists"},
+		{"lcw+Lists@Example.com", "", false, "b-lists"},
+		{"lcw+other@example.com", "", false, "a-plain"},
+		{"lcw@example.net", "", false, "c-alias"},
+		{"lcw+x@example.net", "", false, "c-alias"},
+		{"work@corp.example.com", "", false, "c-alias"},
+		{"joe@corp.example.com", "", false, "d-match"},
+		{"sales-eu@example.org", "", false, "d-match"},
+		{"joe@example.org", "", false, "home"},
+		{"", "", false, "home"},
+
+		// The From header selects the account, not the envelope sender.
+		{"joe@example.org", "lcw@example.com", false, "home"},
+		{"lcw@example.com", "<>", false, "a-plain"},
+		{"lcw@example.com", "bounces+joe=example.org@lists.example.com", false,
+			"a-plain"},
+		{"", "lcw@example.com", false, "a-plain"},
+		{"", "<lcw@example.com>", false, "a-plain"},
+		{"", "<>", false, "home"},
+
+		// Only an unknown sender in the From header is rejected.
+		{"joe@example.org", "", true, ""},
+		{"joe@example.org", "lcw@example.com", true, ""},
+		{"lcw@example.com", "joe@example.org", true, "a-plain"},
+		{"", "joe@example.org", true, "home"},
+		{"", "<>", true, "home"},
+		{"", "", true, "home"},
+	}
+
+	defer func(f string) { *fromFlag = f }(*fromFlag)
+	for _, tt := range tests {
+		*fromFlag = tt.sender
+		config.RejectUnknownFrom = tt.reject
+		got, err := getServerName(config, tt.from)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("%q -f %q: account %q, want an error", tt.from, tt.sender, got)
+		case tt.want == "" && exitCode(err) != exNoPerm:
+			t.Errorf("%q -f %q: exit code %d, want %d", tt.from, tt.sender,
+				exitCode(err), exNoPerm)
+		case tt.want != "" && err != nil:
+			t.Errorf("%q -f %q: %v", tt.from, tt.sender, err)
+		case got != tt.want:
+			t.Errorf("%q -f %q: account %q, want %q", tt.from, tt.sender, got, tt.want)
+		}
+	}
+}
+
+func TestCompleteHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		from   string // the from of the account
+		sender string // the sender given with -f
+		full   string // the name given with -F
+		domain string // the messageIdDomain of the account
+
+		wantFrom string // the From field, or "" for an error
+		idDomain string
+	}{
+		{"account from", "Subject: x\n\nbody\n", "lcw@example.com",
+			"bounces+joe=example.org@lists.example.com", "Lars Wood", "",
+			`"Lars Wood" <lcw@example.com>`, "example.com"},
+		{"sender as last resort", "Subject: x\n\nbody\n", "", "<lcw@example.net>", "",
+			"", "<lcw@example.net>", "example.net"},
+		{"no sender", "Subject: x\n\nbody\n", "", "", "", "", "", ""},
+		{"null sender", "Subject: x\n\nbody\n", "", "<>", "", "", "", ""},
+		{"from kept", "From: Joe <joe@example.org>\n\nbody\n", "lcw@example.com",
+			"", "Lars Wood", "", "Joe <joe@example.org>", "example.org"},
+		{"messageIdDomain", "Subject: x\n\nbody\n", "lcw@example.com", "", "",
+			"mail.example.com", "<lcw@example.com>", "mail.example.com"},
+	}
+
+	defer func(f, full string) {
+		*fromFlag, *fullNameFlag = f, full
+	}(*fromFlag, *fullNameFlag)
+	for _, tt := range tests {
+		*fromFlag, *fullNameFlag = tt.sender, tt.full
+		m, err := parseMail(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = completeHeader(m, server{From: tt.from, MessageIDDomain: tt.domain})
+		if tt.wantFrom == "" {
+			if err == nil {
+				t.Errorf("%s: completeHeader succeeded", tt.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		header, err := textproto.NewReader(bufio.NewReader(
+			strings.NewReader(string(m.header(m.fields))))).ReadMIMEHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := header.Get("From"); got != tt.wantFrom {
+			t.Errorf("%s: From = %s, want %s", tt.name, got, tt.wantFrom)
+		}
+		if _, err := time.Parse(time.RFC1123Z, header.Get("Date")); err != nil {
+			t.Errorf("%s: Date: %v", tt.name, err)
+		}
+		if id := header.Get("Message-ID"); !strings.HasSuffix(id, "@"+tt.idDomain+">") {
+			t.Errorf("%s: Message-ID = %s, want one in %s", tt.name, id, tt.idDomain)
+		}
+	}
+}
+
+// TestFingerprints checks that a server that does not match the fingerprints
+// is given up on in the handshake, before it is sent the credentials.
+func TestFingerprints(t *testing.T) {
+	tests := []struct {
+		name  string
+		chain bool   // whether the server presents a leaf and its issuer
+		pin   string // "leaf", "root" or a fingerprint
+		match string // fingerprintMatch
+		root  bool   // whether the root is pinned with rootPEM
+		ok    bool
+	}{
+		{name: "wrong pin", pin: strings.Repeat("AB", 32)},
+		{name: "wrong pin with rootPEM", pin: strings.Repeat("AB", 32), root: true},
+		{name: "leaf", pin: "leaf", ok: true},
+		{name: "leaf of chain", chain: true, pin: "leaf", ok: true},
+		{name: "leaf with rootPEM", chain: true, pin: "leaf", root: true, ok: true},
+		{name: "root with leaf match", chain: true, pin: "root"},
+		{name: "root with chain match", chain: true, pin: "root", match: matchChain,
+			ok: true},
+		{name: "lower case with colons", pin: "leaf lower", ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeServer(t)
+			leaf := f.cert
+			if tt.chain {
+				leaf = f.useChain(t)
+			}
+			f.ext = []string{"AUTH PLAIN"}
+			f.auth = func(c *textproto.Conn, line string) {
+				c.PrintfLine("235 2.7.0 Accepted")
+			}
+
+			s := f.server()
+			s.Username = "lcw"
+			s.PassEval = []string{"echo", "secret"}
+			if !tt.root {
+				s.RootPEM = ""
+			}
+			s.FingerprintMatch = tt.match
+			switch tt.pin {
+			case "leaf":
+				s.Fingerprints = []string{fingerprint(leaf)}
+			case "leaf lower":
+				var parts []string
+				fp := strings.ToLower(fingerprint(leaf))
+				for i := 0; i < len(fp); i += 2 {
+					parts = append(parts, fp[i:i+2])
+				}
+				s.Fingerprints = []string{strings.Join(parts, ":")}
+			case "root":
+				s.Fingerprints = []string{fingerprint(f.cert)}
+			default:
+				s.Fingerprints = []string{tt.pin}
+			}
+			if err := validateServer(s); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := sendMail(s, "lcw@example.com", []string{"joe@example.net"},
+				strings.NewReader("Subject: test\n\nbody\n"))
+
+			var auth bool
+			for _, cmd := range f.commands() {
+				auth = auth || strings.HasPrefix(cmd, "AUTH")
+			}
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !auth || len(f.messages()) != 1 {
+					t.Errorf("commands = %q, want the message sent after AUTH",
+						f.commands())
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("sendMail succeeded")
+			}
+			if exitCode(err) != exNoPerm {
+				t.Errorf("exit code %d for %v, want %d", exitCode(err), err, exNoPerm)
+			}
+			if auth || len(f.messages()) != 0 {
+				t.Errorf("commands = %q, want none after STARTTLS", f.commands())
+			}
+		})
+	}
+}
+
+// deadAddr returns an address on which nothing listens.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// rcptReplies returns a rcpt function for a fakeServer with the replies to the
+// recipients, which accepts the others.
+func rcptReplies(replies map[string]string) func(int, string) string {
+	return func(n int, addr string) string {
+		return replies[strings.Trim(addr, "<>")]
+	}
+}
+
+// recipients returns the recipients of the transactions the server received.
+func recipients(f *fakeServer) [][]string {
+	var got [][]string
+	for _, m := range f.messages() {
+		var rcpts []string
+		for _, addr := range m.to {
+			rcpts = append(rcpts, strings.Trim(addr, "<>"))
+		}
+		got = append(got, rcpts)
+	}
+	return got
+}
+
+func TestDeliver(t *testing.T) {
+	primary, backup := newFakeServer(t), newFakeServer(t)
+	primary.rcpt = rcptReplies(map[string]string{
+		"b@example.com": "451 4.3.0 Try again later",
+		"c@example.com": "550 5.1.1 No such user",
+		"d@example.com": "451 4.3.0 Try again later",
+	})
+	backup.rcpt = rcptReplies(map[string]string{
+		"d@example.com": "451 4.3.0 Try again later",
+	})
+
+	home := primary.server()
+	home.Addr = deadAddr(t)
+	home.Addresses = []string{primary.addr()}
+	home.Fallback = "backup"
+	config := gsmtpConfig{
+		DefaultServer: "home",
+		Servers:       map[string]server{"home": home, "backup": backup.server()},
+	}
+
+	to := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"}
+	results, err := deliver(config, "home", "lcw@example.com", to,
+		strings.NewReader("Subject: test\n\nbody\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rejection by the first server stands and the recipient that is
+	// still deferred by the last one is returned with its reply.
+	var got []string
+	for _, r := range results {
+		got = append(got, fmt.Sprintf("%s %d", r.addr, exitCode(r.err)))
+	}
+	want := []string{"c@example.com 69", "d@example.com 75"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("results = %q, want %q", got, want)
+	}
+
+	sent := [][]string{{"a@example.com"}}
+	if got := recipients(primary); !reflect.DeepEqual(got, sent) {
+		t.Errorf("primary transactions = %q, want %q", got, sent)
+	}
+	sent = [][]string{{"b@example.com"}}
+	if got := recipients(backup); !reflect.DeepEqual(got, sent) {
+		t.Errorf("backup transactions = %q, want %q", got, sent)
+	}
+	for _, cmd := range backup.commands() {
+		if strings.Contains(cmd, "c@example.com") {
+			t.Errorf("rejected recipient tried on the fallback: %s", cmd)
+		}
+	}
+}
+
+func TestDeliverFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		dead     bool   // whether the first server is down
+		auth     string // the reply of the first server to AUTH
+		code     int    // the exit code of the error
+		fallback bool   // whether the fallback is tried
+	}{
+		{"5xx stops", false, "535 5.7.8 Username and Password not accepted",
+			exNoPerm, false},
+		{"4xx falls back", false, "454 4.7.0 Temporary authentication failure",
+			exTempFail, true},
+		{"dead falls back", true, "", exTempFail, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, backup := newFakeServer(t), newFakeServer(t)
+			primary.ext = []string{"AUTH PLAIN"}
+			primary.auth = func(c *textproto.Conn, line string) {
+				c.PrintfLine("%s", tt.auth)
+			}
+			backup.ext = primary.ext
+			backup.auth = func(c *textproto.Conn, line string) {
+				c.PrintfLine("454 4.7.0 Temporary authentication failure")
+			}
+
+			home := primary.server()
+			if tt.dead {
+				home.Addr = deadAddr(t)
+			}
+			home.Username = "lcw"
+			home.PassEval = []string{"echo", "secret"}
+			home.Fallback = "backup"
+			fallback := backup.server()
+			fallback.Username = home.Username
+			fallback.PassEval = home.PassEval
+			config := gsmtpConfig{
+				DefaultServer: "home",
+				Servers:       map[string]server{"home": home, "backup": fallback},
+			}
+
+			results, err := deliver(config, "home", "lcw@example.com",
+				[]string{"a@example.com"}, strings.NewReader("Subject: test\n\nbody\n"))
+			if err == nil {
+				t.Fatalf("deliver succeeded with %v", results)
+			}
+			if exitCode(err) != tt.code {
+				t.Errorf("exit code %d for %v, want %d", exitCode(err), err, tt.code)
+			}
+			if tried := len(backup.commands()) > 0; tried != tt.fallback {
+				t.Errorf("fallback tried = %v, want %v", tried, tt.fallback)
+			}
+			if len(primary.messages())+len(backup.messages()) != 0 {
+				t.Error("message sent")
+			}
+		})
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	f := newFakeServer(t)
+	f.useImplicitTLS()
+	s := f.server()
+	s.TLS = tlsImplicit
+
+	const msg = "Subject: test\n\nbody\n"
+	if _, err := sendMail(s, "lcw@example.com", []string{"joe@example.net"},
+		strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := f.messages(); len(msgs) != 1 || msgs[0].data != msg {
+		t.Errorf("messages = %+v, want one with %q", msgs, msg)
+	}
+	for _, cmd := range f.commands() {
+		if cmd == "STARTTLS" {
+			t.Error("STARTTLS sent over implicit TLS")
+		}
+	}
+
+	certs, err := getPeerCertificates(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(f.cert) {
+		t.Errorf("certificates = %v, want the one of the server", certs)
+	}
+
+	// The certificate is verified against rootPEM.
+	s.RootPEM = newFakeServer(t).certPEM
+	_, err = sendMail(s, "lcw@example.com", []string{"joe@example.net"},
+		strings.NewReader(msg))
+	if exitCode(err) != exNoPerm {
+		t.Errorf("exit code %d for %v, want %d", exitCode(err), err, exNoPerm)
+	}
+	if len(f.messages()) != 1 {
+		t.Error("message sent to a server that does not match rootPEM")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// serverNames returns the names of the accounts in sorted order, which is
+// the order in which they are tried when selecting an account.
+func serverNames(config gsmtpConfig) []string {
+	names := make([]string, 0, len(config.Servers))
+	for name := range config.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// normalizeAddress lowercases the address and removes a +tag from its local
+// part, so that lcw+lists@Example.com becomes lcw@example.com.
+func normalizeAddress(addr string) string {
+	addr = strings.ToLower(addr)
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr
+	}
+	local, domain := addr[:at], addr[at:]
+	if plus := strings.Index(local, "+"); plus > 0 {
+		local = local[:plus]
+	}
+	return local + domain
+}
+
+// validatePattern checks that the pattern can be used with matchAddress.
+func validatePattern(pattern string) error {
+	if isRegexpPattern(pattern) {
+		_, err := compileRegexpPattern(pattern)
+		return err
+	}
+	_, err := path.Match(strings.ToLower(pattern), "")
+	return err
+}
+
+func isRegexpPattern(pattern string) bool {
+	return len(pattern) >= 2 && strings.HasPrefix(pattern, "/") &&
+		strings.HasSuffix(pattern, "/")
+}
+
+// compileRegexpPattern compiles the regular expression of a "/regexp/"
+// pattern so that it ignores case.  It is compiled as written, since
+// lowercasing it would change escapes like \S.
+func compileRegexpPattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+}
+
+// matchAddress reports whether the address matches the pattern, which is
+// either "@domain" for every address of the domain, "/regexp/" for a regular
+// expression or otherwise a glob pattern as for path.Match.  Case is ignored,
+// and the address also matches if it does without a +tag in its local part.
+func matchAddress(pattern, addr string) bool {
+	addrs := []string{strings.ToLower(addr), normalizeAddress(addr)}
+
+	if isRegexpPattern(pattern) {
+		re, err := compileRegexpPattern(pattern)
+		if err != nil {
+			return false
+		}
+		for _, a := range addrs {
+			if re.MatchString(a) {
+				return true
+			}
+		}
+		return false
+	}
+
+	pattern = strings.ToLower(pattern)
+	for _, a := range addrs {
+		if strings.HasPrefix(pattern, "@") {
+			at := strings.LastIndex(a, "@")
+			if at >= 0 && a[at:] == pattern {
+				return true
+			}
+		} else if ok, _ := path.Match(pattern, a); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether the address matches one of the patterns.
+func matchAny(patterns []string, addr string) bool {
+	for _, pattern := range patterns {
+		if matchAddress(pattern, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// route is a group of recipients together with the account the message is
+// sent to them through.
+type route struct {
+	account string
+	to      []string
+}
+
+// getRoutes groups the recipients by account.  A recipient is sent to through
+// the first account whose matchRecipients it matches, and otherwise through
+// the account selected for the sender.  The -account flag sends to all
+// recipients through the given account.
+func getRoutes(config gsmtpConfig, account string, to []string) []route {
+	if *accountFlag != "" {
+		return []route{{account, to}}
+	}
+
+	names := serverNames(config)
+	var routes []route
+	index := make(map[string]int)
+	for _, addr := range to {
+		name := account
+		for _, n := range names {
+			if matchAny(config.Servers[n].MatchRecipients, addr) {
+				name = n
+				break
+			}
+		}
+
+		i, ok := index[name]
+		if !ok {
+			i = len(routes)
+			index[name] = i
+			routes = append(routes, route{account: name})
+		}
+		routes[i].to = append(routes[i].to, addr)
+	}
+	return routes
+}
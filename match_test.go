@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestMatchAddress(t *testing.T) {
+	tests := []struct {
+		pattern, addr string
+		want          bool
+	}{
+		{"@example.com", "lcw@example.com", true},
+		{"@Example.COM", "LCW@example.com", true},
+		{"@example.com", "lcw@mail.example.com", false},
+		{"@example.com", "lcw@example.com.evil", false},
+
+		{"*@example.com", "lcw@Example.com", true},
+		{"LCW@*.example.com", "lcw@mail.example.com", true},
+		{"lcw@example.com", "lcw+lists@example.com", true},
+		{"lcw+lists@example.com", "lcw+lists@example.com", true},
+		{"lcw+lists@example.com", "lcw@example.com", false},
+		{"lcw-*@example.com", "joe@example.com", false},
+
+		// Escapes are kept as written, even the ones that have a
+		// different meaning in lower case.
+		{`/^\S+@example\.com$/`, "lcw@example.com", true},
+		{`/^\S+@example\.com$/`, "l cw@example.com", false},
+		{`/^\D+@example\.com$/`, "lcw@example.com", true},
+		{`/^\D+@example\.com$/`, "123@example.com", false},
+		{`/^\W/`, "lcw@example.com", false},
+		{`/^\Qlcw+news\E@example\.com$/`, "LCW+news@Example.com", true},
+		{`/^[A-Z]+@EXAMPLE\.com$/`, "lcw@example.com", true},
+		{`/^lcw@example\.com$/`, "lcw+lists@example.com", true},
+		{`/^lcw\+/`, "lcw@example.com", false},
+		{`/[/`, "lcw@example.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchAddress(tt.pattern, tt.addr); got != tt.want {
+			t.Errorf("matchAddress(%q, %q) = %v, want %v", tt.pattern, tt.addr,
+				got, tt.want)
+		}
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		ok      bool
+	}{
+		{"@example.com", true},
+		{"*@example.com", true},
+		{`/^\S+@example\.com$/`, true},
+		{`/^\Qlcw+news\E@/`, true},
+		{`/\P{Greek}/`, true},
+		{"/[/", false},
+		{"/(?z)/", false},
+		{"[", false},
+		{`lcw\`, false},
+	}
+
+	for _, tt := range tests {
+		err := validatePattern(tt.pattern)
+		if (err == nil) != tt.ok {
+			t.Errorf("validatePattern(%q) = %v, want ok %v", tt.pattern, err, tt.ok)
+		}
+	}
+}
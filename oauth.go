@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+var defaultCacheDir = path.Join(userHomeDir(), ".cache", "gsmtp")
+
+// tokenExpiryMargin is subtracted from the lifetime of an access token so that
+// a cached token is not used right before it expires.
+const tokenExpiryMargin = time.Minute
+
+type xoauth2Auth struct {
+	username, token string
+}
+
+// XOAuth2Auth provides the XOAUTH2 authentication used by Gmail and
+// Microsoft 365 for SMTP.
+func XOAuth2Auth(username, token string) smtp.Auth {
+	return &xoauth2Auth{username, token}
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	resp := "user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"
+	return "XOAUTH2", []byte(resp), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server sends a JSON error as a challenge which has to be
+		// answered with an empty response before it fails the command.
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+type oauthBearerAuth struct {
+	username, host, port, token string
+}
+
+// OAuthBearerAuth provides the OAUTHBEARER authentication of RFC 7628.
+func OAuthBearerAuth(username, host, port, token string) smtp.Auth {
+	return &oauthBearerAuth{username, host, port, token}
+}
+
+func (a *oauthBearerAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	resp := "n,a=" + saslName(a.username) + ",\x01host=" + a.host +
+		"\x01port=" + a.port + "\x01auth=Bearer " + a.token + "\x01\x01"
+	return "OAUTHBEARER", []byte(resp), nil
+}
+
+func (a *oauthBearerAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// As with XOAUTH2 an error is reported in a challenge which has to
+		// be answered with the dummy response of RFC 7628.
+		return []byte{0x01}, nil
+	}
+	return nil, nil
+}
+
+// saslName escapes the characters that are special in a GS2 authzid.
+func saslName(s string) string {
+	s = strings.Replace(s, "=", "=3D", -1)
+	return strings.Replace(s, ",", "=2C", -1)
+}
+
+// oauthToken is an access token cached between invocations.
+type oauthToken struct {
+	AccessToken string    `toml:"accessToken"`
+	Expiry      time.Time `toml:"expiry"`
+}
+
+// tokenCacheFile returns the file the access token of the server is cached in.
+// The name is derived from the token endpoint, client and user so that
+// accounts sharing them share the token.
+func tokenCacheFile(s server) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s", s.TokenURL, s.ClientID, s.Username)
+	return path.Join(defaultCacheDir, fmt.Sprintf("token-%x", hash.Sum(nil)[:8]))
+}
+
+// getToken returns an OAuth2 access token for the server, either from the
+// output of tokeneval or from the token endpoint using the refresh token
+// printed by refreshtokeneval.
+func getToken(s server) (string, error) {
+	if len(s.TokenEval) > 0 {
+		out, err := exec.Command(s.TokenEval[0], s.TokenEval[1:]...).Output()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	if s.TokenURL == "" {
+		return "", errors.New("OAuth2 needs tokeneval or tokenURL")
+	}
+
+	cache := tokenCacheFile(s)
+
+	var t oauthToken
+	if _, err := toml.DecodeFile(cache, &t); err == nil {
+		if time.Now().Before(t.Expiry) {
+			return t.AccessToken, nil
+		}
+	}
+
+	t, err := refreshToken(s)
+	if err != nil {
+		return "", err
+	}
+
+	if err = writeToken(cache, t); err != nil {
+		return "", err
+	}
+
+	return t.AccessToken, nil
+}
+
+// refreshToken obtains a new access token from the token endpoint of the
+// server with the refresh token grant.
+func refreshToken(s server) (oauthToken, error) {
+	var t oauthToken
+
+	if len(s.RefreshTokenEval) == 0 {
+		return t, errors.New("tokenURL needs refreshtokeneval")
+	}
+	out, err := exec.Command(s.RefreshTokenEval[0],
+		s.RefreshTokenEval[1:]...).Output()
+	if err != nil {
+		return t, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", strings.TrimSpace(string(out)))
+	form.Set("client_id", s.ClientID)
+	if s.ClientSecret != "" {
+		form.Set("client_secret", s.ClientSecret)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.PostForm(s.TokenURL, form)
+	if err != nil {
+		return t, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return t, fmt.Errorf("Bad response from token endpoint: %s (%v)",
+			resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return t, fmt.Errorf("Token endpoint refused refresh: %s %s %s",
+			resp.Status, body.Error, body.ErrorDescription)
+	}
+
+	t.AccessToken = body.AccessToken
+	t.Expiry = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second -
+		tokenExpiryMargin)
+
+	return t, nil
+}
+
+// writeToken stores the access token in the cache readable only by the user.
+func writeToken(file string, t oauthToken) error {
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return err
+	}
+	return writeTOML(file, t)
+}
+
+// getOAuth returns the smtp.Auth for one of the OAuth2 mechanisms.
+func getOAuth(s server, mech string) (smtp.Auth, error) {
+	token, err := getToken(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if mech == authXOAuth2 {
+		return XOAuth2Auth(s.Username, token), nil
+	}
+
+	host, port, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return OAuthBearerAuth(s.Username, host, port, token), nil
+}
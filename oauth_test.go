@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// tokenEndpoint starts a token endpoint that answers a refresh with the
+// status and JSON body.  The function returned with it counts the requests the
+// endpoint got.
+func tokenEndpoint(t *testing.T, status int, body string) (*httptest.Server, func() int) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var n int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		n++
+		mu.Unlock()
+
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		want := map[string]string{
+			"grant_type":    "refresh_token",
+			"refresh_token": "refresh-1",
+			"client_id":     "gsmtp",
+			"client_secret": "secret",
+		}
+		for k, v := range want {
+			if got := r.PostForm.Get(k); got != v {
+				t.Errorf("%s = %q, want %q", k, got, v)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return n
+	}
+}
+
+// tempCacheDir points the token cache at a directory of the test.
+func tempCacheDir(t *testing.T) {
+	t.Helper()
+	dir := defaultCacheDir
+	defaultCacheDir = t.TempDir()
+	t.Cleanup(func() { defaultCacheDir = dir })
+}
+
+func oauthServer(tokenURL string) server {
+	return server{
+		Addr:             "smtp.example.com:587",
+		Username:         "lcw@example.com",
+		TokenURL:         tokenURL,
+		ClientID:         "gsmtp",
+		ClientSecret:     "secret",
+		RefreshTokenEval: []string{"echo", "refresh-1"},
+	}
+}
+
+func TestGetTokenRefresh(t *testing.T) {
+	tempCacheDir(t)
+	ts, n := tokenEndpoint(t, http.StatusOK,
+		`{"access_token": "access-1", "expires_in": 3600, "token_type": "Bearer"}`)
+	s := oauthServer(ts.URL)
+
+	token, err := getToken(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "access-1" {
+		t.Errorf("token = %q, want %q", token, "access-1")
+	}
+	if n() != 1 {
+		t.Errorf("%d requests, want 1", n())
+	}
+
+	var cached oauthToken
+	if _, err := toml.DecodeFile(tokenCacheFile(s), &cached); err != nil {
+		t.Fatal(err)
+	}
+	if cached.AccessToken != "access-1" {
+		t.Errorf("cached token = %q, want %q", cached.AccessToken, "access-1")
+	}
+	expiry := time.Now().Add(time.Hour - tokenExpiryMargin)
+	if d := expiry.Sub(cached.Expiry); d < 0 || d > time.Minute {
+		t.Errorf("cached expiry = %v, want about %v", cached.Expiry, expiry)
+	}
+	info, err := os.Stat(tokenCacheFile(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("cache file mode = %v, want 0600", perm)
+	}
+
+	// An expired token is refreshed again.
+	cached.Expiry = time.Now().Add(-time.Second)
+	if err := writeToken(tokenCacheFile(s), cached); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getToken(s); err != nil {
+		t.Fatal(err)
+	}
+	if n() != 2 {
+		t.Errorf("%d requests, want 2", n())
+	}
+}
+
+func TestGetTokenCached(t *testing.T) {
+	tempCacheDir(t)
+	ts, n := tokenEndpoint(t, http.StatusOK,
+		`{"access_token": "access-2", "expires_in": 3600}`)
+	s := oauthServer(ts.URL)
+
+	cached := oauthToken{"access-1", time.Now().Add(10 * time.Minute)}
+	if err := writeToken(tokenCacheFile(s), cached); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := getToken(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "access-1" {
+		t.Errorf("token = %q, want the cached %q", token, "access-1")
+	}
+	if n() != 0 {
+		t.Errorf("%d requests, want none", n())
+	}
+
+	// The cache is per token endpoint, client and user.
+	s.Username = "other@example.com"
+	if token, err = getToken(s); err != nil {
+		t.Fatal(err)
+	}
+	if token != "access-2" {
+		t.Errorf("token = %q, want %q", token, "access-2")
+	}
+}
+
+func TestGetTokenError(t *testing.T) {
+	tempCacheDir(t)
+	ts, _ := tokenEndpoint(t, http.StatusBadRequest,
+		`{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`)
+	s := oauthServer(ts.URL)
+
+	_, err := getToken(s)
+	if err == nil {
+		t.Fatal("getToken succeeded")
+	}
+	for _, want := range []string{"400", "invalid_grant", "Token has been expired or revoked."} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not have %q", err, want)
+		}
+	}
+	if _, err := os.Stat(tokenCacheFile(s)); !os.IsNotExist(err) {
+		t.Errorf("cache file written after an error: %v", err)
+	}
+}
+
+func TestOAuthExchange(t *testing.T) {
+	challenge := `{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`
+
+	tests := []struct {
+		mech     string
+		initial  func(port string) string
+		response string
+	}{
+		{authXOAuth2, func(string) string {
+			return "user=lcw@example.com\x01auth=Bearer access-1\x01\x01"
+		}, ""},
+		{authOAuthBearer, func(port string) string {
+			return "n,a=lcw@example.com,\x01host=127.0.0.1\x01port=" + port +
+				"\x01auth=Bearer access-1\x01\x01"
+		}, "\x01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mech, func(t *testing.T) {
+			f := newFakeServer(t)
+			f.ext = []string{"AUTH XOAUTH2 OAUTHBEARER"}
+
+			var mu sync.Mutex
+			var got []string
+			f.auth = func(c *textproto.Conn, line string) {
+				fields := strings.Fields(line)
+				if len(fields) != 3 {
+					c.PrintfLine("501 Initial response expected")
+					return
+				}
+				initial, _ := base64.StdEncoding.DecodeString(fields[2])
+				c.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+				next, err := c.ReadLine()
+				if err != nil {
+					return
+				}
+				response, _ := base64.StdEncoding.DecodeString(next)
+
+				mu.Lock()
+				got = []string{fields[1], string(initial), string(response)}
+				mu.Unlock()
+				c.PrintfLine("535 5.7.8 Username and Password not accepted")
+			}
+
+			s := f.server()
+			s.Username = "lcw@example.com"
+			s.TokenEval = []string{"echo", "access-1"}
+			s.Auth = tt.mech
+			_, err := sendMail(s, "lcw@example.com", []string{"joe@example.net"},
+				strings.NewReader("Subject: test\n\nbody\n"))
+
+			var te *textproto.Error
+			if !errors.As(err, &te) || te.Code != 535 {
+				t.Fatalf("error = %v, want the 535 reply", err)
+			}
+			if !permanent(err) {
+				t.Errorf("error %v is not permanent", err)
+			}
+
+			_, port, _ := net.SplitHostPort(f.addr())
+			want := []string{strings.ToUpper(tt.mech), tt.initial(port), tt.response}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(got) != len(want) {
+				t.Fatalf("exchange = %q, want %q", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("exchange[%d] = %q, want %q", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
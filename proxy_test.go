@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// socksProxy is a SOCKS5 proxy for the tests that connects every request to
+// the same backend and records the address it was asked for.
+type socksProxy struct {
+	l       net.Listener
+	backend string
+
+	user, password string // required unless empty
+	reply          byte   // the reply code to send
+	bound          []byte // the address type and address in the reply
+
+	mu   sync.Mutex
+	atyp byte
+	host string
+}
+
+func newSOCKSProxy(t *testing.T, backend string) *socksProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	p := &socksProxy{l: l, backend: backend, bound: []byte{0x01, 127, 0, 0, 1}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+// request returns the address type and address the proxy was asked for.
+func (p *socksProxy) request() (byte, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.atyp, p.host
+}
+
+func (p *socksProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(br, head); err != nil || head[0] != 0x05 {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return
+	}
+	want := byte(0x00)
+	if p.user != "" {
+		want = 0x02
+	}
+	if !strings.ContainsRune(string(methods), rune(want)) {
+		conn.Write([]byte{0x05, 0xff})
+		return
+	}
+	conn.Write([]byte{0x05, want})
+
+	if want == 0x02 {
+		ver, _ := br.ReadByte()
+		user, password := readSOCKSString(br), readSOCKSString(br)
+		if ver != 0x01 || user != p.user || password != p.password {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil || req[1] != 0x01 {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 0x01, 0x04:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == 0x04 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		io.ReadFull(br, ip)
+		host = ip.String()
+	case 0x03:
+		host = readSOCKSString(br)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(br, port)
+	p.mu.Lock()
+	p.atyp = req[3]
+	p.host = net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(port)))
+	p.mu.Unlock()
+
+	resp := append([]byte{0x05, p.reply, 0x00}, p.bound...)
+	resp = append(resp, 0x00, 0x19)
+	if p.reply != 0x00 {
+		conn.Write(resp)
+		return
+	}
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer backend.Close()
+	conn.Write(resp)
+	pipe(conn, br, backend)
+}
+
+// readSOCKSString reads a string preceded by its length.
+func readSOCKSString(br *bufio.Reader) string {
+	n, err := br.ReadByte()
+	if err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	io.ReadFull(br, b)
+	return string(b)
+}
+
+// pipe copies between the client, which is read through br, and the backend
+// until either side is done.
+func pipe(client net.Conn, br *bufio.Reader, backend net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, br)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, backend)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// httpProxy is an HTTP proxy for the tests that connects every CONNECT
+// request to the same backend.
+type httpProxy struct {
+	l       net.Listener
+	backend string
+
+	auth   string // the required Proxy-Authorization unless empty
+	status int    // the status to reply with
+	// greeting makes the proxy send the greeting of the backend in the
+	// same write as its response.
+	greeting bool
+
+	mu   sync.Mutex
+	host string
+}
+
+func newHTTPProxy(t *testing.T, backend string) *httpProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	p := &httpProxy{l: l, backend: backend, status: http.StatusOK}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *httpProxy) request() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.host
+}
+
+func (p *httpProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	p.mu.Lock()
+	p.host = req.Host
+	p.mu.Unlock()
+
+	status := p.status
+	if p.auth != "" && req.Header.Get("Proxy-Authorization") != p.auth {
+		status = http.StatusProxyAuthRequired
+	}
+	if status != http.StatusOK {
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nProxy-Authenticate: Basic realm=\"test\"\r\n"+
+			"Content-Length: 0\r\n\r\n", status, http.StatusText(status))
+		return
+	}
+
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer backend.Close()
+
+	resp := "HTTP/1.1 200 Connection established\r\n\r\n"
+	if p.greeting {
+		line, err := bufio.NewReader(backend).ReadString('\n')
+		if err != nil {
+			return
+		}
+		resp += line
+	}
+	io.WriteString(conn, resp)
+	pipe(conn, br, backend)
+}
+
+// greet connects to the server of s and returns its greeting, after which it
+// has the connection closed with QUIT, and the connection dialConn wrapped.
+func greet(t *testing.T, s server) (string, net.Conn, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := dialConn(ctx, s)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+
+	c := textproto.NewConn(conn)
+	_, msg, err := c.ReadResponse(220)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Cmd("QUIT"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.ReadResponse(221); err != nil {
+		t.Fatal(err)
+	}
+	return msg, conn.(*deadlineConn).Conn, nil
+}
+
+func proxyServer(proxy string) server {
+	return server{
+		Addr:           "localhost:2525",
+		Proxy:          proxy,
+		ConnectTimeout: duration(5 * time.Second),
+		CommandTimeout: duration(5 * time.Second),
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	f := newFakeServer(t)
+
+	tests := []struct {
+		name     string
+		scheme   string
+		user     string
+		addr     string
+		bound    []byte
+		atyp     byte
+		host     string
+		wantHost bool
+	}{
+		{"socks5h", "socks5h", "", "mail.example.invalid:2525", nil,
+			0x03, "mail.example.invalid:2525", true},
+		{"socks5h with ip", "socks5h", "", "127.0.0.1:2525", nil,
+			0x01, "127.0.0.1:2525", true},
+		{"socks5h with ipv6", "socks5h", "", "[2001:db8::25]:2525", nil,
+			0x04, "[2001:db8::25]:2525", true},
+		{"socks5 resolves locally", "socks5", "", "localhost:2525", nil,
+			0, "", false},
+		{"password", "socks5h", "lcw:secret", "mail.example.invalid:2525",
+			nil, 0x03, "mail.example.invalid:2525", true},
+		{"bound domain", "socks5h", "", "mail.example.invalid:2525",
+			append([]byte{0x03, 11}, "proxy.local"...),
+			0x03, "mail.example.invalid:2525", true},
+		{"bound ipv6", "socks5h", "", "mail.example.invalid:2525",
+			append([]byte{0x04}, net.ParseIP("::1")...),
+			0x03, "mail.example.invalid:2525", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSOCKSProxy(t, f.addr())
+			if tt.bound != nil {
+				p.bound = tt.bound
+			}
+			proxy := tt.scheme + "://" + p.l.Addr().String()
+			if tt.user != "" {
+				p.user, p.password = "lcw", "secret"
+				proxy = tt.scheme + "://" + tt.user + "@" + p.l.Addr().String()
+			}
+
+			s := proxyServer(proxy)
+			s.Addr = tt.addr
+			msg, _, err := greet(t, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg != "fake.example.com ESMTP" {
+				t.Errorf("greeting = %q", msg)
+			}
+
+			atyp, host := p.request()
+			if tt.wantHost {
+				if atyp != tt.atyp || host != tt.host {
+					t.Errorf("request = %d %s, want %d %s", atyp, host,
+						tt.atyp, tt.host)
+				}
+			} else if atyp == 0x03 {
+				t.Errorf("request = %d %s, want an IP address", atyp, host)
+			}
+		})
+	}
+}
+
+func TestSOCKS5Failure(t *testing.T) {
+	f := newFakeServer(t)
+
+	tests := []struct {
+		name  string
+		reply byte
+		user  string // the user of the proxy URL
+		auth  bool   // whether the proxy requires a password
+		code  int
+		err   string
+	}{
+		{"general failure", 0x01, "", false, exTempFail, "general SOCKS server failure"},
+		{"not allowed", 0x02, "", false, exTempFail, "connection not allowed by ruleset"},
+		{"host unreachable", 0x04, "", false, exTempFail, "host unreachable"},
+		{"refused", 0x05, "", false, exTempFail, "connection refused"},
+		{"unknown reply", 0x42, "", false, exTempFail, "unknown error"},
+		{"wrong password", 0x00, "lcw:wrong", true, exNoPerm, "rejected the username and password"},
+		{"password required", 0x00, "", true, exNoPerm, "accepts none of the offered methods"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSOCKSProxy(t, f.addr())
+			p.reply = tt.reply
+			if tt.auth {
+				p.user, p.password = "lcw", "secret"
+			}
+			proxy := "socks5h://" + p.l.Addr().String()
+			if tt.user != "" {
+				proxy = "socks5h://" + tt.user + "@" + p.l.Addr().String()
+			}
+
+			_, _, err := greet(t, proxyServer(proxy))
+			if err == nil {
+				t.Fatal("connected through the proxy")
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %q does not have %q", err, tt.err)
+			}
+			if code := exitCode(err); code != tt.code {
+				t.Errorf("exit code = %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	f := newFakeServer(t)
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("lcw:secret"))
+
+	tests := []struct {
+		name     string
+		user     string
+		auth     string
+		status   int
+		greeting bool
+		code     int
+		err      string
+	}{
+		{"200", "", "", http.StatusOK, false, exOK, ""},
+		{"200 with greeting", "", "", http.StatusOK, true, exOK, ""},
+		{"basic auth", "lcw:secret", auth, http.StatusOK, true, exOK, ""},
+		{"407", "", auth, http.StatusOK, false, exNoPerm,
+			"HTTP proxy refused CONNECT: 407"},
+		{"407 wrong password", "lcw:wrong", auth, http.StatusOK, false, exNoPerm,
+			"HTTP proxy refused CONNECT: 407"},
+		{"502", "", "", http.StatusBadGateway, false, exTempFail,
+			"HTTP proxy cannot connect to localhost:2525: 502 Bad Gateway"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newHTTPProxy(t, f.addr())
+			p.auth, p.status, p.greeting = tt.auth, tt.status, tt.greeting
+			proxy := "http://" + p.l.Addr().String()
+			if tt.user != "" {
+				proxy = "http://" + tt.user + "@" + p.l.Addr().String()
+			}
+
+			msg, conn, err := greet(t, proxyServer(proxy))
+			if tt.err != "" {
+				if err == nil {
+					t.Fatal("connected through the proxy")
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %q does not have %q", err, tt.err)
+				}
+				if code := exitCode(err); code != tt.code {
+					t.Errorf("exit code = %d, want %d", code, tt.code)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg != "fake.example.com ESMTP" {
+				t.Errorf("greeting = %q", msg)
+			}
+			// A greeting read along with the response has to be
+			// passed on from the buffer.
+			if _, ok := conn.(*bufferedConn); tt.greeting && !ok {
+				t.Errorf("connection is %T, want *bufferedConn", conn)
+			}
+			if host := p.request(); host != "localhost:2525" {
+				t.Errorf("CONNECT %s, want localhost:2525", host)
+			}
+		})
+	}
+}
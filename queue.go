@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+var defaultQueueDir = path.Join(userHomeDir(), ".local", "share", "gsmtp", "queue")
+
+const (
+	// defaultQueueMaxAge is how long a message is retried before it is
+	// reported as failed, the same as the default of sendmail.
+	defaultQueueMaxAge = 5 * 24 * time.Hour
+
+	// The time between delivery attempts starts at retryMinBackoff and
+	// doubles with every attempt up to retryMaxBackoff.
+	retryMinBackoff = 5 * time.Minute
+	retryMaxBackoff = 4 * time.Hour
+
+	// staleLockAge is the age after which the lock of a queue entry is
+	// considered left over from a run that died.  A run refreshes the locks
+	// of the entries it delivers every lockRefresh.
+	staleLockAge = 2 * time.Hour
+	lockRefresh  = staleLockAge / 4
+)
+
+// A queue entry consists of the message as it is sent, the envelope and, while
+// a run is working on the entry, a lock.  The envelope is written last, so an
+// entry without one is incomplete and is ignored.
+const (
+	msgSuffix  = ".msg"
+	envSuffix  = ".env"
+	lockSuffix = ".lock"
+	failedDir  = "failed"
+)
+
+// envelope is everything besides the message that is needed to deliver a
+// queued message.
+type envelope struct {
+	From      string    `toml:"from"`
+	To        []string  `toml:"to"`
+	Account   string    `toml:"account"`
+	Created   time.Time `toml:"created"`
+	Attempts  int       `toml:"attempts"`
+	NextTry   time.Time `toml:"nextTry"`
+	LastError string    `toml:"lastError,omitempty"`
+	Held      bool      `toml:"held,omitempty"`
+}
+
+func queueFile(dir, id, suffix string) string {
+	return path.Join(dir, id+suffix)
+}
+
+// newQueueID returns an ID that sorts by the time the message was queued.
+func newQueueID() (string, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%08X%08X", time.Now().Unix(), binary.BigEndian.Uint32(b[:])), nil
+}
+
+// lockEntry takes the lock of the queue entry so that concurrent runs never
+// deliver the same message twice.  It reports false if another run holds the
+// lock.
+func lockEntry(dir, id string) (bool, error) {
+	name := queueFile(dir, id, lockSuffix)
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			return true, f.Close()
+		}
+		if !os.IsExist(err) {
+			return false, err
+		}
+
+		fi, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if time.Since(fi.ModTime()) < staleLockAge {
+			return false, nil
+		}
+
+		if ok, err := breakLock(dir, id); err != nil || !ok {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// breakLock removes the stale lock of the queue entry and reports whether it
+// is gone.  Another run may have broken the same lock and taken the entry in
+// the meantime, so the lock is renamed out of the way first and only removed
+// if it is still stale.  A lock that turns out to be fresh is put back.
+func breakLock(dir, id string) (bool, error) {
+	name := queueFile(dir, id, lockSuffix)
+	suffix, err := newQueueID()
+	if err != nil {
+		return false, err
+	}
+	old := name + "." + suffix
+
+	if err = os.Rename(name, old); os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	fi, err := os.Stat(old)
+	if err != nil {
+		return false, err
+	}
+	if time.Since(fi.ModTime()) < staleLockAge {
+		if err = os.Link(old, name); err != nil {
+			log.Printf("Restoring lock of %s: %v", id, err)
+		}
+		os.Remove(old)
+		return false, nil
+	}
+
+	log.Printf("Breaking stale lock of %s", id)
+	return true, os.Remove(old)
+}
+
+// refreshLock keeps the lock of the queue entry from going stale while the
+// entry is being delivered, which may take longer than staleLockAge when the
+// message is tried on several hops, by touching it every interval until the
+// returned function is called.
+func refreshLock(dir, id string, interval time.Duration) func() {
+	name := queueFile(dir, id, lockSuffix)
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				if err := os.Chtimes(name, now, now); err != nil {
+					log.Printf("Refreshing lock of %s: %v", id, err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func unlockEntry(dir, id string) {
+	if err := os.Remove(queueFile(dir, id, lockSuffix)); err != nil {
+		log.Printf("Unlocking %s: %v", id, err)
+	}
+}
+
+// enqueue writes the message and its envelope to a new entry in the queue.
+// The entry is returned locked so that a concurrent run does not pick it up
+// before it has been delivered the first time.
+func enqueue(dir string, env envelope, msg io.Reader) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	id, err := newQueueID()
+	if err != nil {
+		return "", err
+	}
+
+	if ok, err := lockEntry(dir, id); err != nil {
+		return "", err
+	} else if !ok {
+		return "", fmt.Errorf("Queue ID %s is in use", id)
+	}
+
+	err = writeEntry(dir, id, env, msg)
+	if err != nil {
+		os.Remove(queueFile(dir, id, msgSuffix))
+		unlockEntry(dir, id)
+		return "", err
+	}
+
+	return id, nil
+}
+
+// enqueueCopy writes a new entry to the queue with the envelope env and a
+// message made of header and the body of the message of the entry id, which
+// starts at bodyStart.  Like enqueue it returns the new entry locked.
+func enqueueCopy(dir, id string, bodyStart int64, env envelope,
+	header []byte) (string, error) {
+
+	f, err := os.Open(queueFile(dir, id, msgSuffix))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(bodyStart, io.SeekStart); err != nil {
+		return "", err
+	}
+	return enqueue(dir, env, io.MultiReader(bytes.NewReader(header), f))
+}
+
+// dropEntries removes the locked entries of a message the caller is told was
+// not accepted.
+func dropEntries(dir string, ids []string) {
+	for _, id := range ids {
+		removeEntry(dir, id)
+		unlockEntry(dir, id)
+	}
+}
+
+func writeEntry(dir, id string, env envelope, msg io.Reader) error {
+	f, err := os.OpenFile(queueFile(dir, id, msgSuffix),
+		os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, msg); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return writeEnvelope(dir, id, env)
+}
+
+func readEnvelope(dir, id string) (envelope, error) {
+	var env envelope
+	_, err := toml.DecodeFile(queueFile(dir, id, envSuffix), &env)
+	return env, err
+}
+
+func writeEnvelope(dir, id string, env envelope) error {
+	return writeTOML(queueFile(dir, id, envSuffix), env)
+}
+
+// removeEntry removes a delivered message from the queue.  The lock is left
+// for the caller to release.
+func removeEntry(dir, id string) error {
+	if err := os.Remove(queueFile(dir, id, envSuffix)); err != nil {
+		return err
+	}
+	return os.Remove(queueFile(dir, id, msgSuffix))
+}
+
+// failEntry moves a message that could not be delivered out of the queue and
+// into the failed directory, where it is kept for inspection.
+func failEntry(dir, id string) error {
+	failed := path.Join(dir, failedDir)
+	if err := os.MkdirAll(failed, 0700); err != nil {
+		return err
+	}
+
+	for _, suffix := range []string{msgSuffix, envSuffix} {
+		err := os.Rename(queueFile(dir, id, suffix), queueFile(failed, id, suffix))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queuedIDs returns the IDs of the complete entries in the queue, oldest
+// first.
+func queuedIDs(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), envSuffix) {
+			ids = append(ids, strings.TrimSuffix(f.Name(), envSuffix))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// backoff returns the time to wait before the next delivery attempt.
+func backoff(attempts int) time.Duration {
+	d := retryMinBackoff
+	for i := 1; i < attempts && d < retryMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > retryMaxBackoff {
+		d = retryMaxBackoff
+	}
+	return d
+}
+
+func queueMaxAge(config gsmtpConfig) time.Duration {
+	if config.QueueMaxAge > 0 {
+		return time.Duration(config.QueueMaxAge)
+	}
+	return defaultQueueMaxAge
+}
+
+// deliverEntry sends the queued message through the account of its envelope.
+func deliverEntry(config gsmtpConfig, dir, id string, env envelope) ([]rcptResult, error) {
+	if _, ok := config.Servers[env.Account]; !ok {
+		return nil, configError(fmt.Errorf("Unknown account %q", env.Account))
+	}
+
+	f, err := os.Open(queueFile(dir, id, msgSuffix))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stop := refreshLock(dir, id, lockRefresh)
+	defer stop()
+
+	if *debugFlag {
+		fmt.Printf("Mail:\"\"\"\n")
+		if _, err = io.Copy(os.Stdout, f); err != nil {
+			return nil, err
+		}
+		fmt.Printf("\"\"\"\n")
+	}
+
+	return deliver(config, env.Account, env.From, env.To, f)
+}
+
+// processEntry makes a delivery attempt for the locked queue entry and sorts
+// the recipients into the ones the message was delivered to, the ones to
+// retry later and the ones that failed for good, logging each group.  The
+// recipients to retry stay in the queue with the next attempt scheduled,
+// unless the message has been queued for longer than queueMaxAge.  Once no
+// recipients are left to retry the entry is removed, or moved to the failed
+// directory if keepFailed is set and delivery failed for some recipients.
+// deferred is the reason recipients were kept in the queue and failed the
+// reason recipients failed for good, which is reported as an unknown host only
+// when the message is given up on.
+func processEntry(config gsmtpConfig, dir, id string, env envelope,
+	keepFailed bool) (deferred, failed error) {
+
+	rejected, err := deliverEntry(config, dir, id, env)
+
+	var retry, lost []string
+	var noHost bool
+	switch {
+	case err == nil:
+		var sent []string
+		var tempErr, permErr recipientError
+		for _, to := range env.To {
+			var r *rcptResult
+			for i := range rejected {
+				if rejected[i].addr == to {
+					r = &rejected[i]
+				}
+			}
+
+			switch {
+			case r == nil:
+				sent = append(sent, to)
+			case deferrable(r.err):
+				retry = append(retry, to)
+				tempErr = append(tempErr, rcptResult{to, tempFailure(r.err)})
+				noHost = noHost || exitCode(r.err) == exNoHost
+			default:
+				lost = append(lost, to)
+				permErr = append(permErr, *r)
+			}
+		}
+
+		if len(sent) > 0 {
+			log.Printf("[SENT] from:%s to:%s id:%s", env.From,
+				strings.Join(sent, ", "), id)
+		}
+		if len(tempErr) > 0 {
+			deferred = tempErr
+		}
+		if len(permErr) > 0 {
+			failed = permErr
+		}
+
+	case deferrable(err):
+		retry, deferred = env.To, tempFailure(err)
+		noHost = exitCode(err) == exNoHost
+
+	default:
+		lost, failed = env.To, err
+	}
+
+	if len(retry) > 0 {
+		maxAge := queueMaxAge(config)
+		if time.Since(env.Created) >= maxAge {
+			lost = append(lost, retry...)
+			code := exUnavailable
+			if noHost {
+				code = exNoHost
+			}
+			failed = &exitError{code,
+				fmt.Errorf("Gave up after %v: %v", maxAge, deferred)}
+			retry, deferred = nil, nil
+		} else {
+			env.To = retry
+			env.Attempts++
+			env.NextTry = time.Now().Add(backoff(env.Attempts))
+			env.LastError = deferred.Error()
+			if err := writeEnvelope(dir, id, env); err != nil {
+				return nil, err
+			}
+			log.Printf("[QUEUED] from:%s to:%s id:%s: %v", env.From,
+				strings.Join(retry, ", "), id, deferred)
+		}
+	}
+
+	if len(lost) > 0 {
+		log.Printf("[FAILED] from:%s to:%s id:%s: %v", env.From,
+			strings.Join(lost, ", "), id, failed)
+	}
+
+	if len(retry) == 0 {
+		if len(lost) > 0 && keepFailed {
+			env.To = lost
+			env.LastError = failed.Error()
+			if err := writeEnvelope(dir, id, env); err != nil {
+				log.Printf("Updating %s: %v", id, err)
+			}
+			if err := failEntry(dir, id); err != nil {
+				log.Printf("Moving %s to %s: %v", id, failedDir, err)
+			}
+		} else if err := removeEntry(dir, id); err != nil {
+			log.Printf("Removing %s: %v", id, err)
+		}
+	}
+
+	return deferred, failed
+}
+
+// deferrable reports whether delivery is tried again later after the error.
+// A relay or proxy whose name does not resolve counts as temporary like a
+// network error, since resolvers report names as not found while the host is
+// offline.
+func deferrable(err error) bool {
+	code := exitCode(err)
+	return code == exTempFail || code == exNoHost
+}
+
+// runQueue makes a delivery attempt for every queued message that is due.
+// Messages that fail for good are moved to the failed directory and reported
+// on stderr.
+func runQueue(config gsmtpConfig, dir string) error {
+	ids, err := queuedIDs(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		ok, err := lockEntry(dir, id)
+		if err != nil {
+			log.Printf("Locking %s: %v", id, err)
+			continue
+		} else if !ok {
+			continue
+		}
+
+		// The entry may have been delivered by another run between
+		// listing the queue and taking the lock.
+		env, err := readEnvelope(dir, id)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Reading %s: %v", id, err)
+			}
+			unlockEntry(dir, id)
+			continue
+		}
+
+		if env.Held || time.Now().Before(env.NextTry) {
+			unlockEntry(dir, id)
+			continue
+		}
+
+		_, failed := processEntry(config, dir, id, env, true)
+		if failed != nil {
+			fmt.Fprintf(os.Stderr, "gsmtp: %s: %v\n", id, failed)
+		}
+		unlockEntry(dir, id)
+	}
+
+	return nil
+}
+
+// lockQueued takes the lock of the queue entry given on the command line and
+// reads its envelope.  The caller has to release the lock.
+func lockQueued(dir, id string) (envelope, error) {
+	var env envelope
+
+	if strings.Trim(id, "0123456789ABCDEF") != "" {
+		return env, usageError(fmt.Errorf("Invalid queue ID %q", id))
+	}
+
+	ok, err := lockEntry(dir, id)
+	if err != nil {
+		return env, err
+	} else if !ok {
+		return env, tempFailure(fmt.Errorf("Message %s is being delivered", id))
+	}
+
+	env, err = readEnvelope(dir, id)
+	if err != nil {
+		unlockEntry(dir, id)
+		if os.IsNotExist(err) {
+			return env, usageError(fmt.Errorf("No message %s in the queue", id))
+		}
+		return env, err
+	}
+
+	return env, nil
+}
+
+// deleteQueued removes a message from the queue without delivering it.
+func deleteQueued(dir, id string) error {
+	env, err := lockQueued(dir, id)
+	if err != nil {
+		return err
+	}
+	defer unlockEntry(dir, id)
+
+	if err = removeEntry(dir, id); err != nil {
+		return err
+	}
+	log.Printf("[DELETED] from:%s to:%s id:%s", env.From,
+		strings.Join(env.To, ", "), id)
+	return nil
+}
+
+// holdQueued puts a message on hold, so that queue runs skip it, or releases
+// it again.
+func holdQueued(dir, id string, held bool) error {
+	env, err := lockQueued(dir, id)
+	if err != nil {
+		return err
+	}
+	defer unlockEntry(dir, id)
+
+	env.Held = held
+	return writeEnvelope(dir, id, env)
+}
+
+// retryQueued makes a delivery attempt for a message right away, regardless of
+// when its next attempt is due.
+func retryQueued(config gsmtpConfig, dir, id string) error {
+	env, err := lockQueued(dir, id)
+	if err != nil {
+		return err
+	}
+	defer unlockEntry(dir, id)
+
+	if env.Held {
+		return usageError(fmt.Errorf("Message %s is on hold", id))
+	}
+
+	deferred, failed := processEntry(config, dir, id, env, true)
+	if failed != nil {
+		return failed
+	}
+	return deferred
+}
+
+// listQueue prints the queued messages in the manner of mailq.  Messages on
+// hold are marked with a "!" and messages being delivered with a "*".
+func listQueue(dir string) error {
+	ids, err := queuedIDs(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		fmt.Println("Mail queue is empty")
+		return nil
+	}
+
+	fmt.Println("-Queue ID-------- --Size-- ----Age---- -Account- -Sender/Recipient-----")
+
+	var total int64
+	var n int
+	for _, id := range ids {
+		env, err := readEnvelope(dir, id)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		var size int64
+		if fi, err := os.Stat(queueFile(dir, id, msgSuffix)); err == nil {
+			size = fi.Size()
+		}
+		total += size
+		n++
+
+		mark := " "
+		if env.Held {
+			mark = "!"
+		} else if _, err := os.Stat(queueFile(dir, id, lockSuffix)); err == nil {
+			mark = "*"
+		}
+
+		age := time.Since(env.Created).Round(time.Second)
+		fmt.Printf("%s%s %8d %11s %-9s %s\n", id, mark, size, age,
+			env.Account, env.From)
+		if env.LastError != "" {
+			fmt.Printf("%49s(%s)\n", "", env.LastError)
+		}
+		for _, to := range env.To {
+			fmt.Printf("%49s%s\n", "", to)
+		}
+		fmt.Println()
+	}
+
+	fmt.Printf("-- %d Kbytes in %d Requests.\n", (total+1023)/1024, n)
+	return nil
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ageLock makes the lock of the queue entry look as old as age.
+func ageLock(t *testing.T, dir, id string, age time.Duration) {
+	t.Helper()
+	old := time.Now().Add(-age)
+	if err := os.Chtimes(queueFile(dir, id, lockSuffix), old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lockFiles returns the names of the files in dir.
+func lockFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+func TestLockEntry(t *testing.T) {
+	dir := t.TempDir()
+	id := "0000000000000001"
+
+	if ok, err := lockEntry(dir, id); err != nil || !ok {
+		t.Fatalf("lockEntry = %v, %v, want true", ok, err)
+	}
+	if ok, err := lockEntry(dir, id); err != nil || ok {
+		t.Fatalf("lockEntry of a locked entry = %v, %v, want false", ok, err)
+	}
+
+	ageLock(t, dir, id, staleLockAge-time.Minute)
+	if ok, err := lockEntry(dir, id); err != nil || ok {
+		t.Fatalf("lockEntry of a fresh lock = %v, %v, want false", ok, err)
+	}
+
+	ageLock(t, dir, id, staleLockAge+time.Minute)
+	if ok, err := lockEntry(dir, id); err != nil || !ok {
+		t.Fatalf("lockEntry of a stale lock = %v, %v, want true", ok, err)
+	}
+	if names := lockFiles(t, dir); len(names) != 1 || names[0] != id+lockSuffix {
+		t.Errorf("files = %q, want only the lock", names)
+	}
+
+	unlockEntry(dir, id)
+	if names := lockFiles(t, dir); len(names) != 0 {
+		t.Errorf("files = %q after unlocking, want none", names)
+	}
+}
+
+// TestLockEntryStaleRace has several runs find the same stale lock at once,
+// of which only one may take the entry.
+func TestLockEntryStaleRace(t *testing.T) {
+	dir := t.TempDir()
+	id := "0000000000000002"
+
+	for i := 0; i < 200; i++ {
+		if ok, err := lockEntry(dir, id); err != nil || !ok {
+			t.Fatalf("lockEntry = %v, %v, want true", ok, err)
+		}
+		ageLock(t, dir, id, staleLockAge+time.Minute)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		locked := 0
+		start := make(chan struct{})
+		for j := 0; j < 16; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				ok, err := lockEntry(dir, id)
+				if err != nil {
+					t.Error(err)
+				}
+				if ok {
+					mu.Lock()
+					locked++
+					mu.Unlock()
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if locked != 1 {
+			t.Fatalf("%d runs took the stale lock, want 1", locked)
+		}
+		if names := lockFiles(t, dir); len(names) != 1 {
+			t.Fatalf("files = %q, want only the lock", names)
+		}
+		unlockEntry(dir, id)
+	}
+}
+
+func TestRefreshLock(t *testing.T) {
+	dir := t.TempDir()
+	id := "0000000000000003"
+
+	if ok, err := lockEntry(dir, id); err != nil || !ok {
+		t.Fatalf("lockEntry = %v, %v, want true", ok, err)
+	}
+	ageLock(t, dir, id, staleLockAge-time.Minute)
+
+	stop := refreshLock(dir, id, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	stop()
+
+	fi, err := os.Stat(queueFile(dir, id, lockSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age := time.Since(fi.ModTime()); age > time.Minute {
+		t.Errorf("lock is %v old after refreshing", age)
+	}
+	if ok, err := lockEntry(dir, id); err != nil || ok {
+		t.Errorf("lockEntry of a refreshed lock = %v, %v, want false", ok, err)
+	}
+}
+
+// noSuchHost makes every name resolve as not found for the rest of the test,
+// the way resolvers answer while the host is offline.
+func noSuchHost(t *testing.T) {
+	t.Helper()
+	r := net.DefaultResolver
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go answerNXDomain(server)
+			return client, nil
+		},
+	}
+	t.Cleanup(func() { net.DefaultResolver = r })
+}
+
+// answerNXDomain answers the DNS queries sent over the stream with NXDOMAIN.
+func answerNXDomain(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var n uint16
+		if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+			return
+		}
+		q := make([]byte, n)
+		if _, err := io.ReadFull(conn, q); err != nil || n < 12 {
+			return
+		}
+
+		// The reply is the header and the question of the query, with the
+		// flags of a response with NXDOMAIN and no records.
+		end := 12
+		for end < len(q) && q[end] != 0 {
+			end += int(q[end]) + 1
+		}
+		end += 5
+		if end > len(q) {
+			return
+		}
+		resp := append([]byte(nil), q[:end]...)
+		resp[2], resp[3] = 0x81, 0x83
+		copy(resp[6:12], make([]byte, 6))
+		binary.Write(conn, binary.BigEndian, uint16(len(resp)))
+		conn.Write(resp)
+	}
+}
+
+// TestProcessEntryNoHost checks that a relay or proxy whose name does not
+// resolve keeps the message in the queue until it is given up on.
+func TestProcessEntryNoHost(t *testing.T) {
+	noSuchHost(t)
+
+	tests := []struct {
+		name string
+		s    server
+	}{
+		{"relay", server{Addr: "mail.example.com:587"}},
+		{"proxy", server{Addr: "mail.example.com:587",
+			Proxy: "socks5h://proxy.example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			config := gsmtpConfig{
+				QueueMaxAge: duration(time.Hour),
+				Servers:     map[string]server{"home": tt.s},
+			}
+			env := envelope{
+				From:    "lcw@example.com",
+				To:      []string{"joe@example.net"},
+				Account: "home",
+				Created: time.Now(),
+			}
+			id, err := enqueue(dir, env, strings.NewReader("Subject: test\n\nbody\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unlockEntry(dir, id)
+
+			deferred, failed := processEntry(config, dir, id, env, true)
+			if failed != nil {
+				t.Fatalf("failed = %v, want the message queued", failed)
+			}
+			if exitCode(deferred) != exTempFail {
+				t.Errorf("exit code %d for %v, want %d", exitCode(deferred), deferred,
+					exTempFail)
+			}
+			if env, err = readEnvelope(dir, id); err != nil {
+				t.Fatal(err)
+			}
+			if env.Attempts != 1 || !env.NextTry.After(time.Now()) {
+				t.Errorf("attempts = %d, next try %v, want a retry scheduled",
+					env.Attempts, env.NextTry)
+			}
+
+			// Once the message is given up on the unknown host is reported.
+			env.Created = time.Now().Add(-2 * time.Hour)
+			deferred, failed = processEntry(config, dir, id, env, true)
+			if deferred != nil {
+				t.Errorf("deferred = %v after queueMaxAge", deferred)
+			}
+			if exitCode(failed) != exNoHost {
+				t.Errorf("exit code %d for %v, want %d", exitCode(failed), failed,
+					exNoHost)
+			}
+			if _, err := os.Stat(queueFile(path.Join(dir, failedDir), id,
+				envSuffix)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// queueMessage queues a message for the account home and returns its ID with
+// the entry unlocked.
+func queueMessage(t *testing.T, dir string, env envelope, msg string) string {
+	t.Helper()
+	if env.Account == "" {
+		env.Account = "home"
+	}
+	if env.Created.IsZero() {
+		env.Created = time.Now()
+	}
+	id, err := enqueue(dir, env, strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockEntry(dir, id)
+	return id
+}
+
+func TestHoldQueued(t *testing.T) {
+	f := newFakeServer(t)
+	config := gsmtpConfig{Servers: map[string]server{"home": f.server()}}
+	dir := t.TempDir()
+	id := queueMessage(t, dir, envelope{From: "lcw@example.com",
+		To: []string{"joe@example.net"}}, "Subject: test\n\nbody\n")
+
+	if err := holdQueued(dir, id, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := runQueue(config, dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.commands()) != 0 {
+		t.Errorf("commands = %q, want the held message skipped", f.commands())
+	}
+	if err := retryQueued(config, dir, id); exitCode(err) != exUsage {
+		t.Errorf("retrying a held message: exit code %d for %v, want %d",
+			exitCode(err), err, exUsage)
+	}
+	if env, err := readEnvelope(dir, id); err != nil || !env.Held {
+		t.Fatalf("envelope = %+v, %v, want it held", env, err)
+	}
+
+	if err := holdQueued(dir, id, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := runQueue(config, dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.messages()) != 1 {
+		t.Errorf("%d messages sent, want the released one", len(f.messages()))
+	}
+	if ids, err := queuedIDs(dir); err != nil || len(ids) != 0 {
+		t.Errorf("queue = %q, %v after delivery, want it empty", ids, err)
+	}
+}
+
+func TestDeleteQueued(t *testing.T) {
+	dir := t.TempDir()
+	id := queueMessage(t, dir, envelope{From: "lcw@example.com",
+		To: []string{"joe@example.net"}}, "Subject: test\n\nbody\n")
+
+	if err := deleteQueued(dir, id); err != nil {
+		t.Fatal(err)
+	}
+	if names := lockFiles(t, dir); len(names) != 0 {
+		t.Errorf("files = %q after deleting, want none", names)
+	}
+}
+
+func TestQueueCommandErrors(t *testing.T) {
+	dir := t.TempDir()
+	locked := queueMessage(t, dir, envelope{From: "lcw@example.com",
+		To: []string{"joe@example.net"}}, "Subject: test\n\nbody\n")
+	if ok, err := lockEntry(dir, locked); err != nil || !ok {
+		t.Fatalf("lockEntry = %v, %v, want true", ok, err)
+	}
+	defer unlockEntry(dir, locked)
+
+	config := gsmtpConfig{Servers: map[string]server{"home": {Addr: deadAddr(t)}}}
+	commands := []struct {
+		name string
+		run  func(id string) error
+	}{
+		{"delete", func(id string) error { return deleteQueued(dir, id) }},
+		{"hold", func(id string) error { return holdQueued(dir, id, true) }},
+		{"release", func(id string) error { return holdQueued(dir, id, false) }},
+		{"retry", func(id string) error { return retryQueued(config, dir, id) }},
+	}
+	ids := []struct {
+		id   string
+		code int
+	}{
+		{"../0000000000000001", exUsage},
+		{"0000000000000001.env", exUsage},
+		{"0000000000000001", exUsage},
+		{locked, exTempFail},
+	}
+
+	for _, c := range commands {
+		for _, tt := range ids {
+			if err := c.run(tt.id); exitCode(err) != tt.code {
+				t.Errorf("%s %s: exit code %d for %v, want %d", c.name, tt.id,
+					exitCode(err), err, tt.code)
+			}
+		}
+	}
+	if _, err := readEnvelope(dir, locked); err != nil {
+		t.Errorf("locked entry changed: %v", err)
+	}
+	if names := lockFiles(t, dir); len(names) != 3 {
+		t.Errorf("files = %q, want only the locked entry", names)
+	}
+}
+
+// captureStdout returns what f prints on stdout.
+func captureStdout(t *testing.T, f func() error) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- string(b)
+	}()
+	err = f()
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return <-out
+}
+
+func TestListQueue(t *testing.T) {
+	dir := t.TempDir()
+	list := func() error { return listQueue(dir) }
+	if out := captureStdout(t, list); out != "Mail queue is empty\n" {
+		t.Errorf("empty queue listed as %q", out)
+	}
+
+	const msg = "Subject: test\n\nbody\n"
+	held := queueMessage(t, dir, envelope{
+		From:      "lcw@example.com",
+		To:        []string{"joe@example.net", "ann@example.org"},
+		Account:   "work",
+		Created:   time.Now().Add(-time.Hour),
+		LastError: "451 4.3.0 Try again later",
+		Held:      true,
+	}, msg)
+	locked := queueMessage(t, dir, envelope{From: "lcw@example.com",
+		To: []string{"bob@example.com"}}, msg+msg)
+	if ok, err := lockEntry(dir, locked); err != nil || !ok {
+		t.Fatalf("lockEntry = %v, %v, want true", ok, err)
+	}
+	defer unlockEntry(dir, locked)
+
+	// Entries queued in the same second are listed in any order.
+	out := captureStdout(t, list)
+	entries := make(map[string]string)
+	for _, e := range strings.Split(out, "\n\n") {
+		for _, id := range []string{held, locked} {
+			if strings.Contains(e, id) {
+				entries[id] = e
+			}
+		}
+		if strings.HasPrefix(e, "--") {
+			entries["summary"] = e
+		}
+	}
+
+	tests := []struct {
+		entry string
+		want  []string
+	}{
+		{held, []string{held + "! ", fmt.Sprintf(" %d ", len(msg)), " 1h0m",
+			" work ", " lcw@example.com\n", "(451 4.3.0 Try again later)\n",
+			" joe@example.net\n", " ann@example.org"}},
+		{locked, []string{locked + "* ", fmt.Sprintf(" %d ", 2*len(msg)),
+			" home ", " lcw@example.com\n", " bob@example.com"}},
+		{"summary", []string{"-- 1 Kbytes in 2 Requests.\n"}},
+	}
+	for _, tt := range tests {
+		entry, ok := entries[tt.entry]
+		if !ok {
+			t.Errorf("listing %q does not have %s", out, tt.entry)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(entry, want) {
+				t.Errorf("entry %q does not have %q", entry, want)
+			}
+		}
+	}
+	if strings.Contains(entries[locked], "(") {
+		t.Errorf("entry %q has an error", entries[locked])
+	}
+}
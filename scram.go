@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+// scramAuth implements the SCRAM mechanisms of RFC 5802 and RFC 7677 without
+// channel binding.  The password is used as is rather than being prepared
+// with SASLprep, which only makes a difference for non-ASCII passwords.
+type scramAuth struct {
+	mech               string
+	hash               func() hash.Hash
+	username, password string
+
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool
+}
+
+// ScramSHA1Auth provides SCRAM-SHA-1 authentication for SMTP
+func ScramSHA1Auth(username, password string) smtp.Auth {
+	return &scramAuth{mech: "SCRAM-SHA-1", hash: sha1.New,
+		username: username, password: password}
+}
+
+// ScramSHA256Auth provides SCRAM-SHA-256 authentication for SMTP
+func ScramSHA256Auth(username, password string) smtp.Auth {
+	return &scramAuth{mech: "SCRAM-SHA-256", hash: sha256.New,
+		username: username, password: password}
+}
+
+func (a *scramAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	a.nonce = base64.StdEncoding.EncodeToString(nonce)
+	a.clientFirstBare = "n=" + saslName(a.username) + ",r=" + a.nonce
+	a.serverSignature = nil
+	a.verified = false
+
+	return a.mech, []byte("n,," + a.clientFirstBare), nil
+}
+
+func (a *scramAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		if !a.verified {
+			return nil, errors.New("Server did not send its SCRAM signature")
+		}
+		return nil, nil
+	}
+
+	if a.serverSignature == nil {
+		return a.clientFinal(string(fromServer))
+	}
+
+	attrs := scramAttributes(string(fromServer))
+	if e, ok := attrs["e"]; ok {
+		return nil, fmt.Errorf("SCRAM authentication failed: %s", e)
+	}
+	v, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(v, a.serverSignature) {
+		return nil, errors.New("SCRAM server signature does not match")
+	}
+	a.verified = true
+
+	return []byte{}, nil
+}
+
+// clientFinal computes the client-final-message from the server-first-message
+// and remembers the signature the server has to answer with.
+func (a *scramAuth) clientFinal(serverFirst string) ([]byte, error) {
+	attrs := scramAttributes(serverFirst)
+
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+		return nil, errors.New("SCRAM server nonce is invalid")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, err
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter < 1 {
+		return nil, fmt.Errorf("SCRAM iteration count %q is invalid", attrs["i"])
+	}
+
+	salted := scramHi(a.hash, []byte(a.password), salt, iter)
+	clientKey := scramHMAC(a.hash, salted, "Client Key")
+	serverKey := scramHMAC(a.hash, salted, "Server Key")
+	storedKey := a.hash()
+	storedKey.Write(clientKey)
+
+	// biws is the base64 encoding of the GS2 header "n,,".
+	clientFinal := "c=biws,r=" + nonce
+	authMessage := a.clientFirstBare + "," + serverFirst + "," + clientFinal
+
+	proof := scramHMAC(a.hash, storedKey.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	a.serverSignature = scramHMAC(a.hash, serverKey, authMessage)
+
+	clientFinal += ",p=" + base64.StdEncoding.EncodeToString(proof)
+	return []byte(clientFinal), nil
+}
+
+// scramAttributes splits a SCRAM message into its attributes.
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) >= 2 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+func scramHMAC(h func() hash.Hash, key []byte, msg string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// scramHi is the PBKDF2 based Hi function of RFC 5802.
+func scramHi(h func() hash.Hash, password, salt []byte, iter int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iter; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+// scramVector is a SCRAM exchange for the user "user" with the password
+// "pencil".
+type scramVector struct {
+	name        string
+	auth        func(username, password string) smtp.Auth
+	mech        string
+	nonce       string
+	serverFirst string
+	clientFinal string
+	serverFinal string
+}
+
+var scramVectors = []scramVector{
+	{
+		// RFC 5802, section 5
+		"SHA-1", ScramSHA1Auth, "SCRAM-SHA-1",
+		"fyko+d2lbbFgONRv9qkxdawL",
+		"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j," +
+			"p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		"v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+	},
+	{
+		// RFC 7677, section 3
+		"SHA-256", ScramSHA256Auth, "SCRAM-SHA-256",
+		"rOprNGfwEbeRWgbNEkqO",
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+			"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+			"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	},
+}
+
+// startSCRAM starts the exchange of the vector and replaces the random client
+// nonce with the one of the vector.
+func startSCRAM(t *testing.T, v scramVector) smtp.Auth {
+	t.Helper()
+	a := v.auth("user", "pencil")
+	mech, initial, err := a.Start(&smtp.ServerInfo{Name: "localhost", TLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != v.mech {
+		t.Errorf("mechanism = %s, want %s", mech, v.mech)
+	}
+	if !strings.HasPrefix(string(initial), "n,,n=user,r=") {
+		t.Errorf("client-first-message = %q", initial)
+	}
+
+	sa := a.(*scramAuth)
+	sa.nonce = v.nonce
+	sa.clientFirstBare = "n=user,r=" + v.nonce
+	return a
+}
+
+func TestSCRAM(t *testing.T) {
+	for _, v := range scramVectors {
+		a := startSCRAM(t, v)
+		clientFinal, err := a.Next([]byte(v.serverFirst), true)
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		if string(clientFinal) != v.clientFinal {
+			t.Errorf("%s: client-final-message = %q, want %q", v.name,
+				clientFinal, v.clientFinal)
+		}
+		resp, err := a.Next([]byte(v.serverFinal), true)
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		if len(resp) != 0 {
+			t.Errorf("%s: response to server-final-message = %q", v.name, resp)
+		}
+		if _, err = a.Next(nil, false); err != nil {
+			t.Errorf("%s: 235 after the signature: %v", v.name, err)
+		}
+	}
+}
+
+func TestSCRAMFailure(t *testing.T) {
+	v := scramVectors[1]
+	tests := []struct {
+		name        string
+		serverFirst string
+		serverFinal string // or "" for a 235 right after the client-final
+	}{
+		{"wrong signature", v.serverFirst,
+			"v=" + strings.Repeat("A", 43) + "="},
+		{"signature of another exchange", v.serverFirst, scramVectors[0].serverFinal},
+		{"error", v.serverFirst, "e=invalid-proof"},
+		{"235 without signature", v.serverFirst, ""},
+		{"nonce not extended", strings.Replace(v.serverFirst,
+			"%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0", "", 1), ""},
+		{"other nonce", strings.Replace(v.serverFirst, "rOprNGfwEbeRWgbNEkqO",
+			"xOprNGfwEbeRWgbNEkqO", 1), ""},
+		{"invalid iteration count", strings.Replace(v.serverFirst, "i=4096",
+			"i=0", 1), ""},
+	}
+
+	for _, tt := range tests {
+		a := startSCRAM(t, v)
+		_, err := a.Next([]byte(tt.serverFirst), true)
+		if err == nil {
+			if tt.serverFinal != "" {
+				_, err = a.Next([]byte(tt.serverFinal), true)
+			} else {
+				_, err = a.Next(nil, false)
+			}
+		}
+		if err == nil {
+			t.Errorf("%s: authentication succeeded", tt.name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Timeouts used for servers that do not configure their own.  They are long
+// enough for slow servers and large messages while still ending a connection
+// to a server that stopped answering.
+const (
+	defaultConnectTimeout = 30 * time.Second
+	defaultCommandTimeout = 5 * time.Minute
+	defaultTotalTimeout   = 30 * time.Minute
+)
+
+// orDefault returns the configured timeout, or def if it is not set.
+func orDefault(d duration, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+// serverContext returns the context for a connection to the server, which
+// ends after its total timeout.
+func serverContext(s server) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(),
+		orDefault(s.TotalTimeout, defaultTotalTimeout))
+}
+
+// deadlineConn is a net.Conn on which a read or write fails when it takes
+// longer than timeout or runs past the deadline of ctx.
+type deadlineConn struct {
+	net.Conn
+	ctx     context.Context
+	timeout time.Duration
+}
+
+func (c *deadlineConn) setDeadline() error {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := c.ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return c.Conn.SetDeadline(deadline)
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.setDeadline(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if err := c.setDeadline(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// dialConn connects to the address of the server from its localAddr, through
+// its proxy if it has one, within its connect timeout.  Every read and write
+// on the connection is limited by the command timeout of the server and the
+// deadline of ctx.
+func dialConn(ctx context.Context, s server) (net.Conn, error) {
+	timeout := orDefault(s.ConnectTimeout, defaultConnectTimeout)
+	d := &net.Dialer{Timeout: timeout}
+	if s.LocalAddr != "" {
+		d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(s.LocalAddr)}
+	}
+
+	var conn net.Conn
+	if s.Proxy != "" {
+		proxy, err := parseProxy(s.Proxy)
+		if err != nil {
+			return nil, configError(err)
+		}
+		deadline := time.Now().Add(timeout)
+		if end, ok := ctx.Deadline(); ok && end.Before(deadline) {
+			deadline = end
+		}
+		if conn, err = dialProxy(ctx, d, proxy, s.Addr, deadline); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if conn, err = d.DialContext(ctx, "tcp", s.Addr); err != nil {
+			return nil, err
+		}
+	}
+	return &deadlineConn{conn, ctx,
+		orDefault(s.CommandTimeout, defaultCommandTimeout)}, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blackHole starts a listener that accepts connections and then, unless drip
+// is 0, sends a line of a greeting that never ends every drip.
+func blackHole(t *testing.T, drip time.Duration) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var tick <-chan time.Time
+				if drip > 0 {
+					ticker := time.NewTicker(drip)
+					defer ticker.Stop()
+					tick = ticker.C
+				}
+				for {
+					select {
+					case <-done:
+						return
+					case <-tick:
+						if _, err := conn.Write([]byte("220-still here\r\n")); err != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// TestTimeouts checks that a server that stops answering is given up on after
+// the command timeout, and one that answers too slowly after the total one.
+func TestTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		drip    time.Duration
+		command time.Duration
+		total   time.Duration
+	}{
+		{"command timeout", 0, 200 * time.Millisecond, time.Minute},
+		{"total timeout", 0, time.Minute, 300 * time.Millisecond},
+		{"total timeout while answering", 50 * time.Millisecond,
+			200 * time.Millisecond, 500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := server{
+				Addr:           blackHole(t, tt.drip),
+				Helo:           "client.example.com",
+				ConnectTimeout: duration(time.Minute),
+				CommandTimeout: duration(tt.command),
+				TotalTimeout:   duration(tt.total),
+			}
+			limit := tt.command
+			if tt.total < limit {
+				limit = tt.total
+			}
+
+			start := time.Now()
+			_, err := sendMail(s, "lcw@example.com", []string{"joe@example.net"},
+				strings.NewReader("Subject: test\n\nbody\n"))
+			elapsed := time.Since(start)
+
+			if err == nil {
+				t.Fatal("sendMail succeeded")
+			}
+			if exitCode(err) != exTempFail {
+				t.Errorf("exit code %d for %v, want %d", exitCode(err), err, exTempFail)
+			}
+			if elapsed < limit || elapsed > limit+2*time.Second {
+				t.Errorf("sendMail returned after %v, want about %v", elapsed, limit)
+			}
+		})
+	}
+}